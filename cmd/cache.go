@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type cachedLLM struct {
+	llm LLM
+	dir string
+	ttl time.Duration
+	// refresh skips cached responses (-regen) but still stores the new ones.
+	refresh bool
+}
+
+type cacheEntry struct {
+	Response  string    `json:"response"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newCachedLLM(llm LLM, dir string, ttl time.Duration) *cachedLLM {
+	return &cachedLLM{llm: llm, dir: dir, ttl: ttl}
+}
+
+func (c *cachedLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return c.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (c *cachedLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := c.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+// GenerateWithUsage returns zero usage for a cached response.
+func (c *cachedLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	key := user
+	if system != "" {
+		key = "system:\n" + system + "\nuser:\n" + user
+	}
+	if delta, ok := temperatureJitter(ctx); ok {
+		key = fmt.Sprintf("%s\ntemperature-jitter=%g", key, delta)
+	}
+	path := c.entryPath(model, key)
+	txn, _ := ctx.Value(cacheTxnKey{}).(*cacheTxn)
+
+	if data, err := os.ReadFile(path); err == nil && !c.refresh {
+		var entry cacheEntry
+		if err := json.Unmarshal(data, &entry); err == nil && (c.ttl <= 0 || time.Since(entry.Timestamp) < c.ttl) {
+			if txn != nil {
+				txn.hit(path)
+			}
+			return entry.Response, TokenUsage{}, nil
+		}
+	}
+
+	resp, usage, err := c.llm.GenerateWithUsage(ctx, model, system, user)
+	if err != nil {
+		return "", usage, err
+	}
+
+	if data, err := json.Marshal(cacheEntry{Response: resp, Timestamp: time.Now()}); err == nil {
+		if txn != nil {
+			txn.add(path, data)
+		} else {
+			writeCacheEntry(path, data)
+		}
+	}
+
+	return resp, usage, nil
+}
+
+func writeCacheEntry(path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err == nil {
+		_ = os.WriteFile(path, data, 0o600)
+	}
+}
+
+type cacheTxnKey struct{}
+
+// cacheTxn holds the responses of one generation job until its body is accepted. Nothing
+// is written before that, so an answer that fails the compile check, the tests or the
+// interactive review is not served again on the next run.
+type cacheTxn struct {
+	mu      sync.Mutex
+	entries map[string][]byte // new responses by entry path
+	hits    []string          // entries the job was served from the cache
+}
+
+// withCacheTxn returns ctx carrying a new cacheTxn for the LLM calls made with it.
+func withCacheTxn(ctx context.Context) (context.Context, *cacheTxn) {
+	txn := &cacheTxn{entries: make(map[string][]byte)}
+	return context.WithValue(ctx, cacheTxnKey{}, txn), txn
+}
+
+func (t *cacheTxn) add(path string, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[path] = data
+}
+
+func (t *cacheTxn) hit(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hits = append(t.hits, path)
+}
+
+// finish stores the job's responses when err is nil. Otherwise it drops them and removes
+// the cached responses the job was served, so the next run asks the LLM again.
+func (t *cacheTxn) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		for path, data := range t.entries {
+			writeCacheEntry(path, data)
+		}
+	} else {
+		for _, path := range t.hits {
+			os.Remove(path)
+		}
+	}
+	t.entries = make(map[string][]byte)
+	t.hits = nil
+}
+
+func (c *cachedLLM) entryPath(model, prompt string) string {
+	sum := sha256.Sum256([]byte(model + "\n" + prompt))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func defaultCacheDir() string {
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		return filepath.Join(xdg, "lx")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cache", "lx")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// countingLLM answers each call with a new reply, so a cached reply is easy to tell apart.
+type countingLLM struct{ calls int }
+
+func (c *countingLLM) Generate(ctx context.Context, model, prompt string) (string, error) {
+	c.calls++
+	return fmt.Sprintf("reply %d", c.calls), nil
+}
+
+func (c *countingLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	return c.Generate(ctx, model, user)
+}
+
+func (c *countingLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	text, err := c.Generate(ctx, model, user)
+	return text, TokenUsage{InputTokens: 10, OutputTokens: 2}, err
+}
+
+func TestCacheStoresAcceptedResponsesOnly(t *testing.T) {
+	inner := &countingLLM{}
+	cached := newCachedLLM(inner, t.TempDir(), time.Hour)
+	generate := func(jobErr error) string {
+		t.Helper()
+		ctx, txn := withCacheTxn(context.Background())
+		resp, err := cached.GenerateWithRoles(ctx, "m", "", "prompt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn.finish(jobErr)
+		return resp
+	}
+
+	// A rejected body is not cached.
+	if got := generate(errors.New("compile check failed")); got != "reply 1" {
+		t.Fatalf("first call = %q", got)
+	}
+	if got := generate(nil); got != "reply 2" {
+		t.Fatalf("after a rejected body = %q, want a new reply", got)
+	}
+	// An accepted one is.
+	if got := generate(nil); got != "reply 2" {
+		t.Fatalf("after an accepted body = %q, want the cached reply", got)
+	}
+
+	// A cached reply that fails is dropped.
+	if got := generate(errors.New("tests failed")); got != "reply 2" {
+		t.Fatalf("cached call = %q", got)
+	}
+	if got := generate(nil); got != "reply 3" {
+		t.Fatalf("after a failed cached reply = %q, want a new reply", got)
+	}
+
+	// -regen asks again and stores the new reply.
+	cached.refresh = true
+	if got := generate(nil); got != "reply 4" {
+		t.Fatalf("with refresh = %q, want a new reply", got)
+	}
+	cached.refresh = false
+	if got := generate(nil); got != "reply 4" {
+		t.Fatalf("after refresh = %q, want the refreshed reply", got)
+	}
+}
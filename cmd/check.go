@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func runCheck(opts options, args []string) error {
+	targetDir := "."
+	if len(args) > 0 {
+		targetDir = args[0]
+	}
+
+	failed := false
+	report := func(ok bool, name, detail string) {
+		if !ok {
+			failed = true
+			logger.Error("check failed", "check", name, "detail", detail)
+			return
+		}
+		logger.Info("check passed", "check", name, "detail", detail)
+	}
+
+	if goExe, err := exec.LookPath("go"); err != nil {
+		report(false, "Go toolchain", err.Error())
+	} else {
+		report(true, "Go toolchain", goExe)
+	}
+
+	if info, err := os.Stat(targetDir); err != nil {
+		report(false, "Target directory", err.Error())
+	} else if !info.IsDir() {
+		report(false, "Target directory", targetDir+" is not a directory")
+	} else {
+		report(true, "Target directory", targetDir)
+	}
+
+	cfg, configInfo, err := loadConfig()
+	if err != nil {
+		report(false, "Config", redact(err.Error(), redactSecret))
+		return errors.New("check failed")
+	}
+	if cfg.ApiKey != "" {
+		redactSecret = cfg.ApiKey
+	}
+	report(true, "Config", configInfo)
+
+	formatter := opts.formatter
+	if formatter == "" {
+		formatter = cfg.Formatter
+	}
+	if formatter == "" {
+		formatter = "goimports"
+	}
+	if path, err := exec.LookPath(formatter); err != nil {
+		if _, gofmtErr := exec.LookPath("gofmt"); gofmtErr == nil {
+			report(true, "Formatter", formatter+" not found, gofmt will be used")
+		} else {
+			report(false, "Formatter", err.Error())
+		}
+	} else {
+		report(true, "Formatter", path)
+	}
+
+	llm, err := newLLM(cfg)
+	if err != nil {
+		report(false, "LLM init", redact(err.Error(), redactSecret))
+		return errors.New("check failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.genTimeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := llm.Generate(ctx, cfg.Model, "return 1")
+	latency := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		report(false, fmt.Sprintf("LLM [%s / %s]", cfg.Provider, cfg.Model), diagnoseLLMError(err))
+	} else {
+		report(true, fmt.Sprintf("LLM [%s / %s]", cfg.Provider, cfg.Model),
+			fmt.Sprintf("%s, response: %q", latency, truncateString(singleLine(strings.TrimSpace(resp)), 80)))
+	}
+
+	if failed {
+		return errors.New("check failed")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Exit codes reported in -ci mode.
+const (
+	exitOK        = 0
+	exitFatal     = 1
+	exitFailed    = 2
+	exitNoTargets = 3
+)
+
+const ciFlushMarker = "\x00lx-ci-flush\x00"
+
+// flushOutput drains buffered stdout before the process exits. It is a no-op outside -ci.
+var flushOutput = func() {}
+
+func exit(code int) {
+	removeCaptureBinaries()
+	flushOutput()
+	os.Exit(code)
+}
+
+// enableCIOutput routes stdout through a writer that prints every line with an RFC3339
+// timestamp. Lines starting with "::" are GitHub workflow commands and are passed
+// through untouched.
+func enableCIOutput() {
+	orig := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	os.Stdout = w
+
+	acks := make(chan struct{})
+	go func() {
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for sc.Scan() {
+			line := sc.Text()
+			if line == ciFlushMarker {
+				acks <- struct{}{}
+				continue
+			}
+			writeCILine(orig, line)
+		}
+	}()
+
+	flushOutput = func() {
+		fmt.Fprint(w, "\n"+ciFlushMarker+"\n")
+		<-acks
+	}
+}
+
+func writeCILine(w io.Writer, line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if strings.HasPrefix(line, "::") {
+		fmt.Fprintln(w, line)
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", time.Now().Format(time.RFC3339), line)
+}
+
+// annotateFailure prints a GitHub Actions error annotation for a failed result.
+func annotateFailure(r GenerationResult) {
+	msg := fmt.Sprintf("%s: %s", r.FuncName, r.Error)
+	file := r.FilePath
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+			file = rel
+		}
+	}
+	fmt.Printf("::error file=%s,title=lx generation failed::%s\n", escapeAnnotation(file, true), escapeAnnotation(msg, false))
+}
+
+func escapeAnnotation(s string, property bool) string {
+	s = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+	if property {
+		s = strings.NewReplacer(":", "%3A", ",", "%2C").Replace(s)
+	}
+	return s
+}
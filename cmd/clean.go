@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// runClean turns every generated function back into an lx.Gen stub, so the project can be
+// regenerated from scratch.
+func runClean(args []string) error {
+	fset := flag.NewFlagSet("clean", flag.ContinueOnError)
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+
+	root := "."
+	if fset.NArg() > 0 {
+		root = fset.Arg(0)
+	}
+
+	// A file that cannot be cleaned is logged and skipped, so one bad file does not leave
+	// the rest of the tree half-cleaned.
+	files, funcs, failed := 0, 0, 0
+	err := walkGoFiles(root, pathFilter{}, func(path string, d fs.DirEntry) error {
+		n, err := cleanFile(path)
+		if err != nil {
+			logger.Error("clean failed", "file", path, "err", err)
+			failed++
+			return nil
+		}
+		if n > 0 {
+			logger.Info("Reverted to lx.Gen stubs", "file", path, "functions", n)
+			files++
+			funcs += n
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Clean complete", "files", files, "functions", funcs)
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be cleaned", failed)
+	}
+	return nil
+}
+
+// cleanFile rewrites the generated functions in path and returns how many it reverted.
+func cleanFile(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return 0, err
+	}
+
+	usedBefore := make(map[*ast.ImportSpec]bool)
+	for _, spec := range node.Imports {
+		usedBefore[spec] = usesPackage(node, importName(spec))
+	}
+
+	var reverted []*ast.BlockStmt
+	usesTime := false
+	for _, fn := range funcDecls(node) {
+		if fn.Body == nil {
+			continue
+		}
+		stubs := generatedStubs(node, fn)
+		if len(stubs) == 0 {
+			continue
+		}
+		// The body is overwritten in place: a function literal shares it with its FuncDecl view.
+		old := *fn.Body
+		reverted = append(reverted, &old)
+		usesTime = usesTime || stubsUsePackage(stubs, "time")
+		*fn.Body = *stubBody(fset, fn, stubs)
+	}
+	if len(reverted) == 0 {
+		return 0, nil
+	}
+
+	// Comments from the removed bodies would otherwise be printed into the stubs.
+	var comments []*ast.CommentGroup
+	for _, cg := range node.Comments {
+		if !slices.ContainsFunc(reverted, func(b *ast.BlockStmt) bool { return cg.Pos() > b.Lbrace && cg.End() < b.Rbrace }) {
+			comments = append(comments, cg)
+		}
+	}
+	node.Comments = comments
+
+	dropImportsUnusedAfterClean(node, usedBefore)
+	if !hasImport(node, lxImportPath) {
+		addImport(node, lxImportPath)
+	}
+	// A restored lx.Gen timeout may use time, which goimports dropped with the generated body.
+	if usesTime && !hasImport(node, "time") {
+		addImport(node, "time")
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, node); err != nil {
+		return 0, err
+	}
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(reverted), writeFileAtomic(path, out, info.Mode())
+}
+
+// generatedStub is what lx clean restores for one // lx-prompt: marker (see promptMarker).
+type generatedStub struct {
+	prompt  string
+	call    string   // the original lx.Gen call from // lx-gen:, if recorded
+	hints   []string // from // lx-hint:
+	imports []string // from // lx-import:
+}
+
+// generatedStubs returns the stubs recorded by fn's // lx-prompt: markers, in order, when the
+// body starts with one. Bodies that do not start with a prompt comment were not written by lx.
+func generatedStubs(file *ast.File, fn *ast.FuncDecl) []generatedStub {
+	var stubs []generatedStub
+	for _, cg := range file.Comments {
+		if cg.Pos() < fn.Body.Lbrace || cg.End() > fn.Body.Rbrace {
+			continue
+		}
+		for _, c := range cg.List {
+			if prompt, ok := strings.CutPrefix(c.Text, "// lx-prompt:"); ok {
+				if len(stubs) == 0 && len(fn.Body.List) > 0 && fn.Body.List[0].Pos() < c.Pos() {
+					return nil
+				}
+				stubs = append(stubs, generatedStub{prompt: strings.TrimSpace(prompt)})
+				continue
+			}
+			if len(stubs) == 0 {
+				continue
+			}
+			last := &stubs[len(stubs)-1]
+			if call, ok := strings.CutPrefix(c.Text, "// lx-gen:"); ok {
+				last.call = markerText(call)
+			} else if hint, ok := strings.CutPrefix(c.Text, "// lx-hint:"); ok {
+				last.hints = append(last.hints, markerText(hint))
+			} else if pkg, ok := strings.CutPrefix(c.Text, "// lx-import:"); ok {
+				last.imports = append(last.imports, markerText(pkg))
+			}
+		}
+	}
+	return stubs
+}
+
+// stubsUsePackage reports whether a recorded lx.Gen call of stubs refers to package name.
+func stubsUsePackage(stubs []generatedStub, name string) bool {
+	for _, stub := range stubs {
+		expr, err := parser.ParseExpr(stub.call)
+		if err != nil {
+			continue
+		}
+		used := false
+		ast.Inspect(expr, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok && x.Name == name {
+					used = true
+				}
+			}
+			return !used
+		})
+		if used {
+			return true
+		}
+	}
+	return false
+}
+
+// markerText returns the value of a marker line, unquoting it when it was written quoted.
+func markerText(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, `"`) {
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+	}
+	return s
+}
+
+// stubBody builds the body
+//
+//	{
+//		lx.Lang(...) // and other lx statements kept from the generated body
+//		lx.Hint("...") // and lx.Import, from the body or the markers
+//		lx.GenIf(cond, "prompt") // the recorded call, or lx.Gen("prompt")
+//		return <zero values>
+//	}
+//
+// The return statement keeps the stub compiling for the next capture run. Rbrace is moved
+// to the line after Lbrace so the printer neither joins the block into one line nor keeps
+// the blank lines of the removed body.
+func stubBody(fset *token.FileSet, fn *ast.FuncDecl, stubs []generatedStub) *ast.BlockStmt {
+	var stmts []ast.Stmt
+	kept := make(map[string]bool)
+	keep := func(src string) {
+		if !kept[src] {
+			kept[src] = true
+			stmts = append(stmts, &ast.ExprStmt{X: ast.NewIdent(src)})
+		}
+	}
+
+	for _, stmt := range fn.Body.List {
+		if expr, ok := stmt.(*ast.ExprStmt); ok {
+			if call, ok := expr.X.(*ast.CallExpr); ok && (isLxLangCall(call) || isLxAssertCall(call) || isLxMustCompileCall(call) || isLxCall(call, "Hint") || isLxCall(call, "Import")) {
+				keep(nodeToString(fset, call))
+			}
+		}
+	}
+	for _, stub := range stubs {
+		for _, hint := range stub.hints {
+			keep("lx.Hint(" + strconv.Quote(hint) + ")")
+		}
+		for _, pkg := range stub.imports {
+			keep("lx.Import(" + strconv.Quote(pkg) + ")")
+		}
+	}
+
+	for _, stub := range stubs {
+		if expr, err := parser.ParseExpr(stub.call); err == nil {
+			if call, ok := expr.(*ast.CallExpr); ok && isLxGenCall(call) {
+				stmts = append(stmts, &ast.ExprStmt{X: ast.NewIdent(stub.call)})
+				continue
+			}
+		}
+		stmts = append(stmts, &ast.ExprStmt{X: &ast.CallExpr{
+			Fun:  &ast.SelectorExpr{X: ast.NewIdent("lx"), Sel: ast.NewIdent("Gen")},
+			Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(stub.prompt)}},
+		}})
+	}
+
+	if results := fn.Type.Results; results != nil && len(results.List) > 0 {
+		ret := &ast.ReturnStmt{}
+		if len(results.List[0].Names) == 0 {
+			for _, field := range results.List {
+				ret.Results = append(ret.Results, zeroValueExpr(fset, field.Type))
+			}
+		}
+		stmts = append(stmts, ret)
+	}
+
+	body := &ast.BlockStmt{Lbrace: fn.Body.Lbrace, List: stmts, Rbrace: fn.Body.Rbrace}
+	if tf := fset.File(fn.Body.Lbrace); tf != nil {
+		if line := tf.Line(fn.Body.Lbrace) + 1; line < tf.Line(fn.Body.Rbrace) {
+			body.Rbrace = tf.LineStart(line)
+		}
+	}
+	return body
+}
+
+// zeroValueExpr returns the zero value of typ as an expression: a literal for predeclared
+// types, nil for reference types and *new(T) for everything else.
+func zeroValueExpr(fset *token.FileSet, typ ast.Expr) ast.Expr {
+	switch t := typ.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return &ast.BasicLit{Kind: token.STRING, Value: `""`}
+		case "bool":
+			return ast.NewIdent("false")
+		case "error", "any":
+			return ast.NewIdent("nil")
+		case "int", "int8", "int16", "int32", "int64",
+			"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+			"byte", "rune", "float32", "float64", "complex64", "complex128":
+			return &ast.BasicLit{Kind: token.INT, Value: "0"}
+		}
+	case *ast.StarExpr, *ast.MapType, *ast.ChanType, *ast.FuncType, *ast.InterfaceType:
+		return ast.NewIdent("nil")
+	case *ast.ArrayType:
+		if t.Len == nil {
+			return ast.NewIdent("nil")
+		}
+	}
+	return ast.NewIdent("*new(" + nodeToString(fset, typ) + ")")
+}
+
+func hasImport(file *ast.File, path string) bool {
+	for _, spec := range file.Imports {
+		if p, _ := strconv.Unquote(spec.Path.Value); p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// dropImportsUnusedAfterClean removes the imports only the generated bodies referred to.
+func dropImportsUnusedAfterClean(file *ast.File, usedBefore map[*ast.ImportSpec]bool) {
+	unused := make(map[*ast.ImportSpec]bool)
+	for _, spec := range file.Imports {
+		name := importName(spec)
+		if name != "_" && name != "." && usedBefore[spec] && !usesPackage(file, name) {
+			unused[spec] = true
+		}
+	}
+	if len(unused) == 0 {
+		return
+	}
+
+	var imports []*ast.ImportSpec
+	for _, spec := range file.Imports {
+		if !unused[spec] {
+			imports = append(imports, spec)
+		}
+	}
+	file.Imports = imports
+
+	var decls []ast.Decl
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			decls = append(decls, decl)
+			continue
+		}
+		var specs []ast.Spec
+		for _, spec := range gen.Specs {
+			if !unused[spec.(*ast.ImportSpec)] {
+				specs = append(specs, spec)
+			}
+		}
+		if len(specs) > 0 {
+			gen.Specs = specs
+			decls = append(decls, gen)
+		}
+	}
+	file.Decls = decls
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCleanRestoresGenVariants(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	src := `package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/chebread/lx"
+)
+
+var debug = true
+
+func Upper(s string) string {
+	lx.Hint("keep ASCII only")
+	lx.Import("strings")
+	lx.GenIf(debug, "s in upper case")
+	return ""
+}
+
+func Square(ctx context.Context, n int) int {
+	lx.GenCtx(ctx, "n squared", 30*time.Second)
+	return 0
+}
+
+func Double(n int) int {
+	lx.GenWithExamples("twice n",
+		lx.ExamplePair{Input: 2, Output: 4},
+	)
+	return 0
+}
+`
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := map[string]string{"Upper": "return strings.ToUpper(s)", "Square": "return n * n", "Double": "return n * 2"}
+	for _, target := range scanProjectForLx(dir, pathFilter{}) {
+		job := &genJob{target: target, prompt: singleLine(target.Prompt)}
+		if err := writeGeneratedBody(options{skipCompileCheck: true, formatter: "gofmt"}, job, bodies[target.FuncName], &sync.Mutex{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generated, _ := os.ReadFile(path)
+	for _, want := range []string{
+		"\t// lx-gen: lx.GenIf(debug, \"s in upper case\")\n\t// lx-hint: \"keep ASCII only\"\n\t// lx-import: \"strings\"\n",
+		"\t// lx-gen: lx.GenCtx(ctx, \"n squared\", 30*time.Second)\n",
+		"\t// lx-gen: \"lx.GenWithExamples(\\\"twice n\\\",\\n\\tlx.ExamplePair{Input: 2, Output: 4},\\n)\"\n",
+	} {
+		if !strings.Contains(string(generated), want) {
+			t.Errorf("missing marker %q:\n%s", want, generated)
+		}
+	}
+
+	if n, err := cleanFile(path); err != nil || n != 3 {
+		t.Fatalf("cleanFile = %d, %v; want 3 functions", n, err)
+	}
+	out, _ := os.ReadFile(path)
+	for _, want := range []string{
+		"\tlx.Hint(\"keep ASCII only\")\n\tlx.Import(\"strings\")\n\tlx.GenIf(debug, \"s in upper case\")\n\treturn \"\"\n",
+		"\tlx.GenCtx(ctx, \"n squared\", 30*time.Second)\n\treturn 0\n",
+		"\tlx.GenWithExamples(\"twice n\",\n\t\tlx.ExamplePair{Input: 2, Output: 4},\n\t)\n\treturn 0\n",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("missing %q after clean:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), `"strings"`+"\n") {
+		t.Errorf("import used only by the generated code was kept:\n%s", out)
+	}
+}
+
+func TestCleanRestoresTimeImport(t *testing.T) {
+	// goimports removed time along with the generated body.
+	path := filepath.Join(t.TempDir(), "main.go")
+	src := "package main\n\nfunc Square(n int) int {\n\t// lx-prompt: n squared\n\t// lx-gen: lx.Gen(\"n squared\", 30*time.Second)\n\treturn n * n\n}\n"
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cleanFile(path); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, path, "package main\n\nimport (\n\t\"github.com/chebread/lx\"\n\t\"time\"\n)\n\nfunc Square(n int) int {\n\tlx.Gen(\"n squared\", 30*time.Second)\n\treturn 0\n}\n")
+}
+
+func TestCleanParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(path, []byte("package main\n\nfunc F( {\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cleanFile(path); err == nil {
+		t.Error("expected the parse error")
+	}
+}
+
+func TestRunCleanSkipsFailedFiles(t *testing.T) {
+	dir := t.TempDir()
+	generated := "package main\n\nfunc F() int {\n\t// lx-prompt: one\n\treturn 1\n}\n"
+	for name, src := range map[string]string{"a.go": "package main\n\nfunc G( {\n", "b.go": generated} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := runClean([]string{dir})
+	if err == nil || !strings.Contains(err.Error(), "1 file(s)") {
+		t.Errorf("err = %v, want one failed file", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "b.go")); !strings.Contains(string(got), `lx.Gen("one")`) {
+		t.Errorf("b.go not cleaned after the failure in a.go:\n%s", got)
+	}
+}
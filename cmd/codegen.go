@@ -1,170 +1,967 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/chebread/lx/pkg/lxerr"
 )
 
-var logMu sync.Mutex
+// diffMu keeps dry-run diffs and interactive prompts from interleaving.
+var diffMu sync.Mutex
 
-func processSingleTarget(opts options, llm LLM, cfg *Config, target TargetInfo, fileMu *sync.Mutex) {
-	displayPath := target.FilePath
-	taskName := fmt.Sprintf("[%s -> %s]", displayPath, target.FuncName)
+type genJob struct {
+	target    TargetInfo
+	taskName  string
+	signature string
+	prompt    string
+	spec      string
 
-	logMu.Lock()
-	fmt.Printf("[lx] %s Generate code\n", taskName)
-	logMu.Unlock()
+	// system and user are set when the config has system_role or user_role; the prompt is
+	// then sent as two messages (see buildGenMessages).
+	system, user string
 
-	fileMu.Lock()
+	// parsed is the file as read when the job was prepared. It is reused when the body is
+	// written, unless another target has rewritten the file in the meantime.
+	parsed *parsedFile
+}
 
+// parsedFile is a source file together with the AST parsed from exactly those bytes.
+type parsedFile struct {
+	src  []byte
+	fset *token.FileSet
+	node *ast.File
+}
+
+func parseTargetFile(path string, src []byte) (*parsedFile, error) {
 	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	return &parsedFile{src: src, fset: fset, node: node}, nil
+}
+
+func processSingleTarget(opts options, llm LLM, cfg *Config, target TargetInfo, fileMu *sync.Mutex, results chan<- GenerationResult) {
+	start := time.Now()
 
-	node, err := parser.ParseFile(fset, target.FilePath, nil, parser.ParseComments)
+	opts, cfg, err := applyFileConfig(opts, cfg, target.FileConfig)
 	if err != nil {
-		fileMu.Unlock()
-		logMu.Lock()
-		fmt.Printf("[lx] %s parse failed: %v\n", taskName, err)
-		logMu.Unlock()
+		logger.Error("invalid lx:config", "file", target.FilePath, "func", qualifiedFuncName(target.FuncName, target.ReceiverType), "err", err)
+		sendResult(opts, results, newGenerationResult(target, 0, err, start))
 		return
 	}
 
-	var currentFn *ast.FuncDecl
-	ast.Inspect(node, func(n ast.Node) bool {
-		if fn, ok := n.(*ast.FuncDecl); ok && fn.Name.Name == target.FuncName {
-			currentFn = fn
-			return false
+	spanCtx, endSpan := startSpan(spanRoot, "generate", "func.name", qualifiedFuncName(target.FuncName, target.ReceiverType), "llm.model", cfg.Model)
+	defer endSpan()
+
+	job, err := prepareGenJob(opts, cfg, target, fileMu)
+	if err != nil {
+		sendResult(opts, results, newGenerationResult(target, 0, err, start))
+		return
+	}
+
+	timeout := opts.genTimeout
+	if target.Timeout > 0 {
+		timeout = target.Timeout
+	}
+	ctx, cancel := context.WithTimeout(spanCtx, timeout)
+	defer cancel()
+	ctx, txn := withCacheTxn(ctx)
+
+	var generatedCode string
+	if opts.candidates > 1 {
+		generatedCode, err = generateCandidates(ctx, opts, llm, cfg, job, fileMu)
+	} else {
+		system, user := buildGenMessages(opts, job)
+		generatedCode, err = llm.GenerateWithRoles(ctx, cfg.Model, system, user)
+	}
+	if errors.Is(err, errSimulated) {
+		sendResult(opts, results, newGenerationResult(target, 0, err, start))
+		return
+	}
+	if errors.Is(err, errCostLimit) {
+		logger.Info("skipped: -cost-limit reached", "task", job.taskName)
+		sendResult(opts, results, newGenerationResult(target, 0, err, start))
+		return
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		logger.Error("code generation timed out", "task", job.taskName, "gen_timeout", timeout)
+		sendResult(opts, results, newGenerationResult(target, 0, &lxerr.ErrTimeout{Stage: "generation", After: timeout}, start))
+		return
+	}
+	if err != nil {
+		logger.Error("code generation failed", "task", job.taskName, "err", diagnoseLLMError(err))
+		sendResult(opts, results, newGenerationResult(target, 0, &lxerr.ErrLLMFailed{Provider: cfg.Provider, Cause: err}, start))
+		return
+	}
+
+	lines, err := completeGenJob(ctx, opts, llm, cfg, job, generatedCode, fileMu)
+	txn.finish(err)
+	sendResult(opts, results, newGenerationResult(target, lines, err, start))
+}
+
+// recoverGeneration is deferred around processSingleTarget. It turns a panic, such as a nil
+// pointer from an unexpected AST shape, into a failed result instead of a crash of the run.
+func recoverGeneration(opts options, results chan<- GenerationResult, target TargetInfo, start time.Time) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	name := qualifiedFuncName(target.FuncName, target.ReceiverType)
+	logger.Error(fmt.Sprintf("generation panicked for %s: %v", name, r), "file", target.FilePath)
+	sendResult(opts, results, newGenerationResult(target, 0, fmt.Errorf("generation panicked: %v", r), start))
+}
+
+// recoverBatch is deferred around processBatch like recoverGeneration. A panic becomes a
+// failed result for each target processBatch had not reported yet.
+func recoverBatch(opts options, results chan<- GenerationResult, targets []TargetInfo, reported []bool, start time.Time) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	for i, target := range targets {
+		if reported[i] {
+			continue
 		}
-		return true
-	})
+		name := qualifiedFuncName(target.FuncName, target.ReceiverType)
+		logger.Error(fmt.Sprintf("generation panicked for %s: %v", name, r), "file", target.FilePath)
+		sendResult(opts, results, newGenerationResult(target, 0, fmt.Errorf("generation panicked: %v", r), start))
+	}
+}
+
+// applyFileConfig layers a file's "// lx:config" overrides on top of the run's options and config.
+func applyFileConfig(opts options, cfg *Config, overrides map[string]string) (options, *Config, error) {
+	for key, value := range overrides {
+		switch key {
+		case "model":
+			c := *cfg
+			c.Model = value
+			cfg = &c
+		case "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return opts, cfg, fmt.Errorf("lx:config: invalid timeout %q", value)
+			}
+			opts.genTimeout = d
+		case "max-prompt", "max-output":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return opts, cfg, fmt.Errorf("lx:config: invalid %s %q", key, value)
+			}
+			if key == "max-prompt" {
+				opts.maxPromptChars = n
+			} else {
+				opts.maxOutputBytes = n
+			}
+		default:
+			return opts, cfg, fmt.Errorf("lx:config: unknown key %q (supported: model, timeout, max-prompt, max-output)", key)
+		}
+	}
+	return opts, cfg, nil
+}
+
+// processBatch generates targets with one LLM call. reported[i] is set once the result of
+// targets[i] is sent, so recoverBatch can tell which targets a panic left without one.
+func processBatch(opts options, llm LLM, cfg *Config, targets []TargetInfo, reported []bool, fileLocks map[string]*sync.Mutex, results chan<- GenerationResult) {
+	start := time.Now()
+
+	var jobs []*genJob
+	var jobTargets []int
+	report := func(j int, r GenerationResult) {
+		reported[jobTargets[j]] = true
+		sendResult(opts, results, r)
+	}
+	for i, t := range targets {
+		job, err := prepareGenJob(opts, cfg, t, fileLocks[t.FilePath])
+		if err != nil {
+			reported[i] = true
+			sendResult(opts, results, newGenerationResult(t, 0, err, start))
+			continue
+		}
+		jobs = append(jobs, job)
+		jobTargets = append(jobTargets, i)
+	}
+	if len(jobs) == 0 {
+		return
+	}
+
+	// A batch shares one context, so it gets the longest per-function timeout.
+	timeout := opts.genTimeout
+	if longest := slices.MaxFunc(jobs, func(a, b *genJob) int {
+		return cmp.Compare(a.target.Timeout, b.target.Timeout)
+	}).target.Timeout; longest > 0 {
+		timeout = longest
+	}
+	ctx, cancel := context.WithTimeout(spanRoot, timeout)
+	defer cancel()
+	// The batch response is only cached when every body in it was accepted.
+	ctx, txn := withCacheTxn(ctx)
+
+	specs := make([]batchSpec, 0, len(jobs))
+	for i, job := range jobs {
+		specs = append(specs, batchSpec{
+			ID:   i + 1,
+			Func: qualifiedFuncName(job.target.FuncName, job.target.ReceiverType),
+			File: filepath.Base(job.target.FilePath),
+			Spec: job.spec,
+		})
+	}
 
-	if currentFn == nil || currentFn.Body == nil {
-		fileMu.Unlock()
-		logMu.Lock()
-		fmt.Printf("[lx] %s function not found or has no body\n", taskName)
-		logMu.Unlock()
+	rules := genRules
+	if opts.explain && opts.maxTurns < 2 {
+		rules += explainSection
+	}
+
+	batched := &batchedLLM{llm: llm}
+	items, err := batched.GenerateBatch(ctx, cfg.Model, rules, specs)
+	if err != nil {
+		for _, job := range jobs {
+			if errors.Is(err, errSimulated) {
+				continue
+			} else if errors.Is(err, errCostLimit) {
+				logger.Info("skipped: -cost-limit reached", "task", job.taskName)
+			} else {
+				logger.Error("code generation failed", "task", job.taskName, "err", diagnoseLLMError(err))
+			}
+		}
+		if !errors.Is(err, errSimulated) && !errors.Is(err, errCostLimit) {
+			err = &lxerr.ErrLLMFailed{Provider: cfg.Provider, Cause: err}
+		}
+		for j, job := range jobs {
+			report(j, newGenerationResult(job.target, 0, err, start))
+		}
 		return
 	}
 
-	signature := extractSignature(fset, currentFn)
+	bodies := matchBatchItems(specs, items)
+	var failed error
+	for j, job := range jobs {
+		body, found := bodies[j]
+		if !found {
+			logger.Error("missing from batch response", "task", job.taskName)
+			failed = errors.New("missing from batch response")
+			report(j, newGenerationResult(job.target, 0, failed, start))
+			continue
+		}
+		jobCtx, endSpan := startSpan(ctx, "generate", "func.name", qualifiedFuncName(job.target.FuncName, job.target.ReceiverType), "llm.model", cfg.Model)
+		lines, err := completeGenJob(jobCtx, opts, llm, cfg, job, body, fileLocks[job.target.FilePath])
+		endSpan()
+		if err != nil {
+			failed = err
+		}
+		report(j, newGenerationResult(job.target, lines, err, start))
+	}
+	txn.finish(failed)
+}
+
+func prepareGenJob(opts options, cfg *Config, target TargetInfo, fileMu *sync.Mutex) (*genJob, error) {
+	displayPath := target.FilePath
+	taskName := fmt.Sprintf("[%s -> %s]", displayPath, qualifiedFuncName(target.FuncName, target.ReceiverType))
+
+	if target.Condition != "" {
+		logger.Info("Generate code", "task", taskName, "condition", target.Condition)
+	} else {
+		logger.Info("Generate code", "task", taskName)
+	}
+
+	var (
+		parsed                         *parsedFile
+		currentFn                      *ast.FuncDecl
+		prompt, signature, surrounding string
+	)
+	// The lock is released by defer so a panic in the AST code cannot leave the file locked.
+	err := func() error {
+		fileMu.Lock()
+		defer fileMu.Unlock()
+
+		src, err := os.ReadFile(target.FilePath)
+		if err != nil {
+			logger.Error("read failed", "task", taskName, "err", err)
+			return fmt.Errorf("read failed: %w", err)
+		}
+		parsed, err = parseTargetFile(target.FilePath, src)
+		if err != nil {
+			logger.Error("parse failed", "task", taskName, "err", err)
+			return fmt.Errorf("parse failed: %w", err)
+		}
+
+		currentFn = findFuncDecl(parsed.node, target.FuncName, target.ReceiverType)
+
+		if currentFn == nil || currentFn.Body == nil {
+			logger.Error("function not found or has no body", "task", taskName)
+			return errors.New("function not found or has no body")
+		}
+
+		prompt = singleLine(target.Prompt)
+		if opts.sanitizePrompt {
+			var n int
+			if prompt, n = sanitizePrompt(prompt, opts.sanitizers); n > 0 {
+				logger.Warn("redacted sensitive data from the prompt", "task", taskName, "matches", n)
+			}
+		}
+		prompt = truncateString(prompt, opts.maxPromptChars)
+		if !opts.regen && hasPromptCommentIn(parsed.node, currentFn, prompt) {
+			logger.Info("skipped: already generated (use -regen to replace it)", "task", taskName)
+			return fmt.Errorf("%w: already generated for this prompt", errSkipped)
+		}
 
-	fileMu.Unlock()
+		if !opts.force && !target.Segmented {
+			if n := bodyLogicLines(parsed.fset, target.FilePath, currentFn); n > opts.minBodyLines {
+				logger.Warn("body already has code; skipping so it is not overwritten (use -force)", "task", taskName, "lines", n, "min_body_lines", opts.minBodyLines)
+				return fmt.Errorf("%w: body has %d lines of code", errSkipped, n)
+			}
+		}
 
-	prompt := truncateString(singleLine(target.Prompt), opts.maxPromptChars)
+		signature = extractSignature(parsed.fset, currentFn)
+		if opts.contextLines > 0 {
+			surrounding = surroundingCode(parsed.fset, target.FilePath, currentFn, opts.contextLines)
+		}
+
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	fset, node := parsed.fset, parsed.node
 	isVoid := currentFn.Type.Results == nil || len(currentFn.Type.Results.List) == 0
 
 	outputSection := ""
+	var retTypes []string
 	if isVoid {
 		outputSection = "\n[VOID FUNCTION]\nThis function has NO return values. Focus strictly on logic and side effects (printing, etc).\n"
+		if opts.noSpy {
+			outputSection += "The program was not run, so no runtime data is available; work from TASK and SIG alone.\n"
+		}
+		if target.CallArgs != "" {
+			var names []string
+			for _, p := range valueParams(currentFn) {
+				names = append(names, p.Name)
+			}
+			outputSection += fmt.Sprintf("Arguments (%s) it was called with during the captured run:\n%s\n", strings.Join(names, ", "), truncateString(target.CallArgs, opts.maxOutputBytes))
+		}
+		if target.Output != "" && target.Output != "null" && target.Output != "<nil>" {
+			outputSection += fmt.Sprintf("Captured state of its pointer, slice and map parameters after the call:\n%s\n", truncateString(target.Output, opts.maxOutputBytes))
+		}
 	} else {
-		var retTypes []string
 		for _, field := range currentFn.Type.Results.List {
 			retTypes = append(retTypes, nodeToString(fset, field.Type))
 		}
 		retTypeStr := strings.Join(retTypes, ", ")
 
-		outputSection = fmt.Sprintf("\n[RETURN VALUES REQUIRED]\nThis function MUST return values of type: (%s)\n", retTypeStr)
+		if opts.noSpy {
+			outputSection = fmt.Sprintf("\n[NO RUNTIME DATA]\nThe program was not run, so no sample output is available; work from TASK and SIG alone. This function MUST return values of type: (%s)\n", retTypeStr)
+		} else {
+			outputSection = fmt.Sprintf("\n[RETURN VALUES REQUIRED]\nThis function MUST return values of type: (%s)\n", retTypeStr)
+		}
 
 		if target.Output != "" && target.Output != "null" && target.Output != "<nil>" {
 			outBytes := []byte(target.Output)
 			if len(outBytes) > opts.maxOutputBytes {
 				outBytes = append(outBytes[:opts.maxOutputBytes], []byte("\n... [truncated]")...)
 			}
-			outputSection += fmt.Sprintf("Captured sample output shape:\n%s\n", string(outBytes))
-		} else {
+			if target.OutputCalls > 0 {
+				outputSection += fmt.Sprintf("[SAMPLE OUTPUTS (%d calls)]\nValues returned across the captured calls; handle every pattern:\n%s\n", target.OutputCalls, string(outBytes))
+			} else {
+				outputSection += fmt.Sprintf("Captured sample output shape:\n%s\n", string(outBytes))
+			}
+		} else if len(target.ExamplePairs) == 0 && !opts.noSpy {
 			outputSection += "Note: The trace run returned nil or empty, but you MUST still provide a valid return statement matching the signature.\n"
 		}
 	}
 
-	systemPrompt := fmt.Sprintf(`GO FUNC BODY GEN.
+	if target.ReceiverType != "" {
+		outputSection += fmt.Sprintf("\n[METHOD]\nThis is a method on %s.", target.ReceiverType)
+		if name := receiverName(currentFn); name != "" && name != "_" {
+			outputSection += fmt.Sprintf(" Access the receiver through %q.", name)
+		}
+		outputSection += "\n"
+	}
 
-SIG: %s
+	if len(target.RequiredImports) > 0 {
+		outputSection += fmt.Sprintf("\n[IMPORTS]\nThese packages are imported for you; use them where they fit: %s\n", strings.Join(target.RequiredImports, ", "))
+	}
+
+	if target.Segmented {
+		outputSection += fmt.Sprintf("\n[PARTIAL BODY]\nThis function is built in steps, one lx.Gen call per step. Generate ONLY the statements for step #%d; they replace the statements from that lx.Gen call up to the next one. Do not repeat other steps. Include a return statement only if this step ends the function.\nCURRENT BODY:\n%s\n",
+			target.PromptIndex+1,
+			truncateString(extractBody(fset, currentFn), opts.maxBodyChars),
+		)
+	}
+
+	if decls := fileContext(fset, node); decls != "" {
+		outputSection += fmt.Sprintf("\n[FILE CONTEXT]\nTop-level declarations in the same file. Use these exact names and types:\n%s\n",
+			truncateString(decls, opts.maxBodyChars),
+		)
+	}
+
+	if surrounding != "" {
+		outputSection += fmt.Sprintf("\n[SURROUNDING CODE]\nCode right before and after this function in the same file:\n%s\n",
+			truncateString(surrounding, opts.maxBodyChars/2),
+		)
+	}
+
+	if opts.contextDepth > 0 {
+		if called := findCalledFuncs(opts.targetDir, opts.filter, target.FilePath, currentFn, opts.contextDepth, opts.maxBodyChars); len(called) > 0 {
+			outputSection += fmt.Sprintf("\n[CALLED FUNCTIONS]\nFunctions this one calls, defined in the same project. Call them instead of reimplementing them:\n%s\n",
+				truncateString(strings.Join(called, "\n\n"), opts.maxBodyChars),
+			)
+		}
+	} else if called := calledTargetSources(target.CalledTargets, opts.maxBodyChars); len(called) > 0 {
+		outputSection += fmt.Sprintf("\n[CALLED FUNCTIONS]\nFunctions this one calls, generated earlier in this run. Call them instead of reimplementing them:\n%s\n",
+			truncateString(strings.Join(called, "\n\n"), opts.maxBodyChars),
+		)
+	}
+
+	if opts.includeCallers {
+		if sites := findCallSites(opts.targetDir, opts.filter, target, 5); len(sites) > 0 {
+			outputSection += fmt.Sprintf("\n[CALL SITES]\nHow the rest of the project calls this function:\n%s\n", strings.Join(sites, "\n\n"))
+		}
+	}
+
+	if len(target.ExamplePairs) > 0 {
+		var sb strings.Builder
+		for i, p := range target.ExamplePairs {
+			fmt.Fprintf(&sb, "Example %d:\nInput: %s\nOutput: %s\n", i+1, p.Input, p.Output)
+		}
+		outputSection += fmt.Sprintf("\n[EXAMPLES]\nFor these inputs the function MUST produce these outputs:\n%s",
+			truncateString(sb.String(), opts.maxOutputBytes),
+		)
+	}
+
+	if len(target.Examples) > 0 {
+		outputSection += fmt.Sprintf("\n[GO EXAMPLE TEST]\nThe implementation MUST satisfy these Go assertions:\n%s\n", strings.Join(target.Examples, "\n"))
+	}
+
+	spec := fmt.Sprintf(`SIG: %s
 
 TASK: %s
 
-%s
+%s`, signature, prompt, outputSection)
+	data := promptData{
+		Signature:     signature,
+		Prompt:        prompt,
+		OutputSection: outputSection,
+		ReturnTypes:   retTypes,
+		IsVoid:        isVoid,
+	}
+	if cfg.PromptTemplate != "" {
+		spec, err = renderPrompt(cfg.PromptTemplate, data)
+		if err != nil {
+			logger.Error("prompt template failed", "task", taskName, "err", err)
+			return nil, err
+		}
+	}
 
-RULES:
+	var system, user string
+	if cfg.SystemRole != "" || cfg.UserRole != "" {
+		system, user = "GO FUNC BODY GEN.", spec
+		if cfg.SystemRole != "" {
+			if system, err = renderPrompt(cfg.SystemRole, data); err != nil {
+				logger.Error("system_role template failed", "task", taskName, "err", err)
+				return nil, err
+			}
+		}
+		if cfg.UserRole != "" {
+			if user, err = renderPrompt(cfg.UserRole, data); err != nil {
+				logger.Error("user_role template failed", "task", taskName, "err", err)
+				return nil, err
+			}
+		}
+	}
+
+	return &genJob{
+		target:    target,
+		taskName:  taskName,
+		signature: signature,
+		prompt:    prompt,
+		spec:      spec,
+		system:    system,
+		user:      user,
+		parsed:    parsed,
+	}, nil
+}
+
+// promptData is what a prompt_template from the config is rendered with.
+type promptData struct {
+	Signature     string
+	Prompt        string
+	OutputSection string
+	ReturnTypes   []string
+	IsVoid        bool
+}
+
+// renderPrompt renders a prompt_template. Its output replaces the SIG/TASK part of the prompt;
+// genRules are still appended so the response can be parsed.
+func renderPrompt(tmpl string, data promptData) (string, error) {
+	t, err := template.New("prompt_template").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("prompt_template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("prompt_template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+const genRules = `RULES:
 1. OUTPUT BODY ONLY. Do NOT include the "func Name() {" line.
 2. NO MARKDOWN.
 3. NO "lx.Gen".
 4. NEVER add network calls or file I/O unless explicitly required by TASK.
 5. USE // lx-dep: for any new imports/packages you use.
 6. START directly with logic.
-7. COMPLIANCE: If the function signature has return types, you MUST include a return statement.`, signature, prompt, outputSection)
+7. COMPLIANCE: If the function signature has return types, you MUST include a return statement.`
 
-	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
-	defer cancel()
+// fileContext renders the file's top-level import, const, var and type declarations.
+func fileContext(fset *token.FileSet, file *ast.File) string {
+	var decls []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.File:
+			return true
+		case *ast.GenDecl:
+			decls = append(decls, nodeToString(fset, n))
+		}
+		return false
+	})
+	return strings.Join(decls, "\n\n")
+}
 
-	generatedCode, err := llm.Generate(ctx, cfg.Model, systemPrompt)
+// surroundingCode returns up to n source lines before fn and n lines after it, with a marker
+// where fn itself sits.
+func surroundingCode(fset *token.FileSet, path string, fn *ast.FuncDecl, n int) string {
+	src, err := os.ReadFile(path)
 	if err != nil {
-		logMu.Lock()
-		fmt.Printf("[lx] %s code generation failed\n", taskName)
-		fmt.Printf("[lx] Error: %s\n", diagnoseLLMError(err))
-		logMu.Unlock()
-		return
+		return ""
+	}
+	start := fset.Position(fn.Pos()).Offset
+	end := fset.Position(fn.End()).Offset
+	if start > end || end > len(src) {
+		return ""
+	}
+
+	before := strings.Split(string(src[:start]), "\n")
+	before = before[:len(before)-1] // the partial line holding "func"
+	before = before[max(0, len(before)-n):]
+
+	after := strings.Split(string(src[end:]), "\n")
+	after = after[1:min(len(after), n+1)] // drop the rest of the closing-brace line
+
+	parts := append(before, "// ... "+qualifiedFuncName(fn.Name.Name, receiverType(fn))+" ...")
+	parts = append(parts, after...)
+	return strings.Trim(strings.Join(parts, "\n"), "\n")
+}
+
+// defaultMinBodyLines is the -min-body-lines default: bodies with more lines of code than
+// this are taken to hold code lx did not write.
+const defaultMinBodyLines = 3
+
+// bodyLogicLines counts the non-empty, non-comment lines of fn's body, ignoring lx.* calls.
+func bodyLogicLines(fset *token.FileSet, path string, fn *ast.FuncDecl) int {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	start := fset.Position(fn.Body.Lbrace).Offset + 1
+	end := fset.Position(fn.Body.Rbrace).Offset
+	if start >= end || end > len(src) {
+		return 0
+	}
+
+	n := 0
+	inBlock := false
+	for _, line := range strings.Split(string(src[start:end]), "\n") {
+		t := strings.TrimSpace(line)
+		if inBlock {
+			if strings.Contains(t, "*/") {
+				inBlock = false
+			}
+			continue
+		}
+		if strings.HasPrefix(t, "/*") {
+			inBlock = !strings.Contains(t, "*/")
+			continue
+		}
+		if t == "" || strings.HasPrefix(t, "//") || strings.HasPrefix(t, "lx.") {
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+func buildGenPrompt(opts options, job *genJob) string {
+	systemPrompt := "GO FUNC BODY GEN.\n\n" + job.spec + "\n\n" + genRules
+	if opts.explain && opts.maxTurns < 2 {
+		systemPrompt += explainSection
+	}
+	return systemPrompt
+}
+
+// buildGenMessages returns the system and user messages for job. With system_role or
+// user_role configured, the rules go in the system message and the function's task in the
+// user message; otherwise system is empty and user is buildGenPrompt.
+func buildGenMessages(opts options, job *genJob) (system, user string) {
+	if job.system == "" && job.user == "" {
+		return "", buildGenPrompt(opts, job)
+	}
+	system = job.system + "\n\n" + genRules
+	if opts.explain && opts.maxTurns < 2 {
+		system += explainSection
+	}
+	return system, job.user
+}
+
+// generateCandidates asks for opts.candidates bodies concurrently, each with a different
+// temperature jitter, and returns the raw response of the best-scoring one.
+func generateCandidates(ctx context.Context, opts options, llm LLM, cfg *Config, job *genJob, fileMu *sync.Mutex) (string, error) {
+	system, user := buildGenMessages(opts, job)
+	raw := make([]string, opts.candidates)
+	errs := make([]error, opts.candidates)
+
+	var wg sync.WaitGroup
+	for i := range opts.candidates {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			delta := 0.1 * (float32(i) - float32(opts.candidates-1)/2)
+			raw[i], errs[i] = llm.GenerateWithRoles(withTemperatureJitter(ctx, delta), cfg.Model, system, user)
+		}(i)
+	}
+	wg.Wait()
+
+	var responses, bodies []string
+	for i, r := range raw {
+		if errs[i] == nil && strings.TrimSpace(r) != "" {
+			responses = append(responses, r)
+			bodies = append(bodies, cleanAICode(r))
+		}
+	}
+	if len(responses) == 0 {
+		return "", errors.Join(errs...)
+	}
+
+	check := func(body string) (compiles, vetClean bool) {
+		return evaluateCandidate(opts, job, body, fileMu)
+	}
+	_, scores := scoreCandidates(bodies, job.signature, check)
+
+	if opts.genTests {
+		breakTiesWithTests(opts, job, bodies, scores, fileMu)
+	}
+	chosen := argMax(scores)
+
+	for i, score := range scores {
+		logger.Info("candidate scored", "task", job.taskName, "candidate", fmt.Sprintf("%d/%d", i+1, len(scores)), "score", score, "chosen", i == chosen)
+	}
+
+	return responses[chosen], nil
+}
+
+// scoreCandidates ranks cleaned bodies. A body that does not compile scores -1; otherwise
+// points are added for a clean go vet, a reasonable length and a required return statement.
+func scoreCandidates(candidates []string, sig string, check func(body string) (compiles, vetClean bool)) (best string, scores []int) {
+	needsReturn := signatureHasResults(sig)
+	scores = make([]int, len(candidates))
+
+	for i, body := range candidates {
+		compiles, vetClean := check(body)
+		if !compiles {
+			scores[i] = -1
+			continue
+		}
+
+		score := 10
+		if vetClean {
+			score += 3
+		}
+		if n := len(strings.Split(strings.TrimSpace(body), "\n")); n >= 1 && n <= 60 {
+			score += 2
+		}
+		if !needsReturn || strings.Contains(body, "return") {
+			score += 2
+		}
+		scores[i] = score
+	}
+
+	if len(candidates) > 0 {
+		best = candidates[argMax(scores)]
+	}
+	return best, scores
+}
+
+func argMax(scores []int) int {
+	best := 0
+	for i, s := range scores {
+		if s > scores[best] {
+			best = i
+		}
 	}
+	return best
+}
 
-	cleaned := cleanAICode(generatedCode)
-	deps := extractDependencies(cleaned)
+func signatureHasResults(sig string) bool {
+	file, err := parser.ParseFile(token.NewFileSet(), "", "package p\n"+sig+" {}", 0)
+	if err != nil || len(file.Decls) == 0 {
+		return false
+	}
+	fn, ok := file.Decls[0].(*ast.FuncDecl)
+	return ok && fn.Type.Results != nil && len(fn.Type.Results.List) > 0
+}
 
+func renderCandidate(opts options, job *genJob, body string, fileMu *sync.Mutex) ([]byte, error) {
 	fileMu.Lock()
 	defer fileMu.Unlock()
 
-	freshFset := token.NewFileSet()
-	freshNode, err := parser.ParseFile(freshFset, target.FilePath, nil, parser.ParseComments)
+	pf, fn, seg, body, err := locateGenTarget(job, body)
 	if err != nil {
-		fmt.Printf("[lx] %s re-parse failed: %v\n", taskName, err)
-		return
+		return nil, err
 	}
+	marker := promptMarker(job.target, job.prompt, seg == nil)
+	return renderGeneratedSource(opts, job.target.FilePath, pf, fn, seg, marker, body, job.target.RequiredImports)
+}
 
-	var freshFn *ast.FuncDecl
-	ast.Inspect(freshNode, func(n ast.Node) bool {
-		if fn, ok := n.(*ast.FuncDecl); ok && fn.Name.Name == target.FuncName {
-			freshFn = fn
-			return false
-		}
-		return true
-	})
+// evaluateCandidate splices body into the target file in memory and reports whether the
+// package compiles and passes go vet.
+func evaluateCandidate(opts options, job *genJob, body string, fileMu *sync.Mutex) (compiles, vetClean bool) {
+	newSrc, err := renderCandidate(opts, job, body, fileMu)
+	if err != nil {
+		return false, false
+	}
 
-	if freshFn == nil || freshFn.Body == nil {
-		fmt.Printf("[lx] %s function not found during re-parse\n", taskName)
+	if _, err := checkCompiles(job.target.FilePath, newSrc, opts.tags); err != nil {
+		return false, false
+	}
+	_, vetErr := checkVet(job.target.FilePath, newSrc, opts.tags)
+	return true, vetErr == nil
+}
+
+// breakTiesWithTests runs the package tests against every top-scoring candidate and
+// gives a point to those that pass.
+func breakTiesWithTests(opts options, job *genJob, bodies []string, scores []int, fileMu *sync.Mutex) {
+	top := scores[argMax(scores)]
+	var tied []int
+	for i, s := range scores {
+		if s == top {
+			tied = append(tied, i)
+		}
+	}
+	if top < 0 || len(tied) < 2 {
 		return
 	}
 
-	if ok := applyCodeToFile(target.FilePath, freshFn, freshFset, prompt, cleaned); ok {
-		logMu.Lock()
-		fmt.Printf("[lx] %s complete\n", taskName)
-		if len(deps) > 0 {
-			fmt.Printf("[lx] %s deps (manual): %s\n", taskName, strings.Join(uniqueStrings(deps), ", "))
+	for _, i := range tied {
+		newSrc, err := renderCandidate(opts, job, bodies[i], fileMu)
+		if err != nil {
+			continue
+		}
+		if _, err := runGoWithOverlay(job.target.FilePath, newSrc, opts.tags, "test", "-count=1"); err == nil {
+			scores[i]++
 		}
-		logMu.Unlock()
 	}
 }
 
-func cleanAICode(code string) string {
-	if start := strings.Index(code, "```"); start != -1 {
-		if firstNL := strings.Index(code[start:], "\n"); firstNL != -1 {
-			content := code[start+firstNL+1:]
-			if last := strings.LastIndex(content, "```"); last != -1 {
-				code = content[:last]
+func completeGenJob(ctx context.Context, opts options, llm LLM, cfg *Config, job *genJob, generatedCode string, fileMu *sync.Mutex) (int, error) {
+	taskName := job.taskName
+	testWritten := false
+
+	for attempt := 0; ; attempt++ {
+		cleaned := cleanAICode(generatedCode)
+
+		if opts.explain && opts.maxTurns >= 2 {
+			commented, err := llm.Generate(ctx, cfg.Model, buildExplainPrompt(job.signature, cleaned))
+			if err != nil {
+				logger.Warn("explain turn failed, keeping uncommented body", "task", taskName, "err", diagnoseLLMError(err))
+			} else if c := cleanAICode(commented); strings.TrimSpace(c) != "" {
+				cleaned = c
 			}
 		}
-	}
 
-	if strings.Contains(code, "func ") && strings.Contains(code, "{") {
-		if open := strings.Index(code, "{"); open != -1 {
-			if close := strings.LastIndex(code, "}"); close != -1 {
-				code = code[open+1 : close]
+		deps := extractDependencies(cleaned)
+		if opts.autoDeps && len(deps) > 0 {
+			// Installed before writing so the compile check can resolve the new imports.
+			installDependencies(opts, taskName, filepath.Dir(job.target.FilePath), deps)
+		}
+
+		_, endApply := startSpan(ctx, "apply", "func.name", qualifiedFuncName(job.target.FuncName, job.target.ReceiverType))
+		err := writeGeneratedBody(opts, job, cleaned, fileMu)
+		endApply()
+		if err == nil {
+			if attempt > 0 {
+				logger.Info("complete", "task", taskName, "retries", attempt)
+			} else {
+				logger.Info("complete", "task", taskName)
+			}
+			if len(deps) > 0 && !opts.autoDeps {
+				logger.Info("deps (manual)", "task", taskName, "deps", strings.Join(uniqueStrings(deps), ", "))
+			}
+			lines := strings.Count(cleaned, "\n") + 1
+			if (!opts.genTests && !opts.verify) || opts.dryRun {
+				return lines, nil
+			}
+
+			if opts.genTests && !testWritten {
+				generateCompanionTest(ctx, opts, llm, cfg, job, cleaned, fileMu)
+				testWritten = true
+			}
+			testName := companionTestName(job.target)
+			var (
+				testOut string
+				ran     bool
+				testErr error
+			)
+			if opts.verify {
+				testName = "go test"
+				testOut, testErr = runPackageTests(ctx, opts, job, attempt)
+				ran = true
+			} else if testOut, ran, testErr = runCompanionTest(ctx, opts, job); ran {
+				if testErr == nil {
+					logger.Info("tests passed", "task", taskName)
+				} else {
+					logger.Warn("tests failed", "task", taskName, "attempt", attempt+1)
+				}
 			}
+			if !ran || testErr == nil {
+				return lines, nil
+			}
+
+			// A staged step's lx.Gen marker is gone once written, so only whole bodies are retried.
+			if attempt >= opts.maxRetries || job.target.Segmented {
+				return lines, fmt.Errorf("%s failed: %w\n%s", testName, testErr, truncateString(strings.TrimSpace(testOut), opts.maxOutputBytes))
+			}
+			system, user := buildTestRetryPrompt(opts, job, cleaned, testOut)
+			generatedCode, err = llm.GenerateWithRoles(ctx, cfg.Model, system, user)
+			if err != nil {
+				logger.Error("code generation failed", "task", taskName, "err", diagnoseLLMError(err))
+				return lines, &lxerr.ErrLLMFailed{Provider: cfg.Provider, Cause: err}
+			}
+			continue
+		}
+
+		var ce *lxerr.ErrCompileFailed
+		if !errors.As(err, &ce) {
+			logger.Error("write failed", "task", taskName, "err", err)
+			return 0, err
+		}
+
+		if attempt >= opts.maxRetries {
+			logger.Error("compile check failed, file left unchanged", "task", taskName, "retries", attempt, "err", ce.Err, "output", ce.Output)
+			return 0, ce
 		}
+
+		logger.Warn("compile check failed, retrying", "task", taskName, "attempt", attempt+1, "max_retries", opts.maxRetries)
+
+		system, user := buildRetryPrompt(opts, job, cleaned, ce.Output)
+		generatedCode, err = llm.GenerateWithRoles(ctx, cfg.Model, system, user)
+		if err != nil {
+			logger.Error("code generation failed", "task", taskName, "err", diagnoseLLMError(err))
+			return 0, &lxerr.ErrLLMFailed{Provider: cfg.Provider, Cause: err}
+		}
+	}
+}
+
+func writeGeneratedBody(opts options, job *genJob, cleaned string, fileMu *sync.Mutex) error {
+	target := job.target
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	pf, fn, seg, cleaned, err := locateGenTarget(job, cleaned)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer
+	if opts.dryRun {
+		out = os.Stdout
+	}
+
+	// lx.MustCompile keeps the compile check, run before anything is written, even with
+	// -skip-compile-check, so a body that does not build is retried and never lands.
+	if target.MustCompile {
+		opts.skipCompileCheck = false
+	}
+
+	marker := promptMarker(target, job.prompt, seg == nil)
+	return applyCodeToFile(opts, out, target.FilePath, pf, fn, seg, marker, cleaned, target.RequiredImports)
+}
+
+func buildRetryPrompt(opts options, job *genJob, previous, compilerOutput string) (system, user string) {
+	system, user = buildGenMessages(opts, job)
+	return system, user + fmt.Sprintf(`
+
+[PREVIOUS ATTEMPT FAILED]
+The previous body did not compile. Fix it.
+
+PREVIOUS BODY:
+%s
+
+GO BUILD STDERR:
+%s`, previous, strings.TrimSpace(compilerOutput))
+}
+
+func buildTestRetryPrompt(opts options, job *genJob, previous, testOutput string) (system, user string) {
+	system, user = buildGenMessages(opts, job)
+	return system, user + fmt.Sprintf(`
+
+[TEST FAILURES]
+The previous body compiled but failed its tests. Fix it so the tests pass.
+
+PREVIOUS BODY:
+%s
+
+GO TEST OUTPUT:
+%s`, previous, truncateString(strings.TrimSpace(testOutput), opts.maxOutputBytes))
+}
+
+const explainSection = `
+
+[EXPLAIN: For each non-trivial step in the implementation, add a brief inline comment explaining the reasoning.]`
+
+func buildExplainPrompt(signature, body string) string {
+	return fmt.Sprintf(`GO FUNC BODY COMMENT.
+
+SIG: %s
+
+BODY:
+%s
+
+RULES:
+1. OUTPUT BODY ONLY. Do NOT include the "func Name() {" line.
+2. NO MARKDOWN.
+3. DO NOT change any code. Only add comments.
+4. KEEP every existing // lx-dep: comment.`, signature, body) + explainSection
+}
+
+func cleanAICode(code string) string {
+	code = stripCodeFence(code)
+
+	// Only a leading declaration is unwrapped; function literals inside the body are kept.
+	if strings.HasPrefix(strings.TrimSpace(code), "func ") {
+		code = funcDeclBody(code)
 	}
 
 	trimmed := strings.TrimSpace(code)
@@ -172,11 +969,10 @@ func cleanAICode(code string) string {
 		code = trimmed[1 : len(trimmed)-1]
 	}
 
-	lines := strings.Split(code, "\n")
+	lines := strings.Split(stripLxStmts(code), "\n")
 	var finalLines []string
 	for _, line := range lines {
-		t := strings.TrimSpace(line)
-		if t == "" || strings.Contains(t, "lx.Gen(") {
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
 		finalLines = append(finalLines, line)
@@ -185,47 +981,589 @@ func cleanAICode(code string) string {
 	return strings.Join(finalLines, "\n")
 }
 
-func applyCodeToFile(path string, fn *ast.FuncDecl, fset *token.FileSet, prompt, generated string) bool {
+// stripLxStmts removes the lx.Gen, lx.Lang, lx.Assert and lx.MustCompile statements an
+// answer repeats from the function; locateGenTarget puts back the ones that belong in the
+// body. Like extractLangStmts it looks at the top-level statements, so a call spanning
+// several lines goes as a whole and code that merely mentions lx is kept. A body that does
+// not parse is returned unchanged, for the compile check to report.
+func stripLxStmts(body string) string {
+	const prefix = "package p\nfunc _() {\n"
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", prefix+body+"\n}\n", 0)
+	if err != nil || len(file.Decls) != 1 {
+		return body
+	}
+	fn, ok := file.Decls[0].(*ast.FuncDecl)
+	if !ok {
+		return body
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, stmt := range fn.Body.List {
+		expr, ok := stmt.(*ast.ExprStmt)
+		if !ok {
+			continue
+		}
+		call, ok := expr.X.(*ast.CallExpr)
+		if !ok || !(isLxGenCall(call) || isLxLangCall(call) || isLxAssertCall(call) || isLxMustCompileCall(call)) {
+			continue
+		}
+		start := fset.Position(stmt.Pos()).Offset - len(prefix)
+		sb.WriteString(body[last:start])
+		last = fset.Position(stmt.End()).Offset - len(prefix)
+		if rest := strings.TrimLeft(body[last:], " \t"); strings.HasPrefix(rest, ";") {
+			last = len(body) - len(strings.TrimLeft(rest[1:], " \t"))
+		}
+	}
+	sb.WriteString(body[last:])
+	return sb.String()
+}
+
+// funcDeclBody returns the text between the braces of the function declaration in code.
+// Code that is not a single declaration with a body is returned unchanged.
+func funcDeclBody(code string) string {
+	const prefix = "package p\n"
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", prefix+code, 0)
+	if err != nil || len(file.Decls) != 1 {
+		return code
+	}
+	fn, ok := file.Decls[0].(*ast.FuncDecl)
+	if !ok || fn.Body == nil {
+		return code
+	}
+	open := fset.Position(fn.Body.Lbrace).Offset - len(prefix)
+	close := fset.Position(fn.Body.Rbrace).Offset - len(prefix)
+	return code[open+1 : close]
+}
+
+type bodySegment struct {
+	start token.Pos
+	end   token.Pos
+}
+
+func findGenSegment(fset *token.FileSet, file *ast.File, fn *ast.FuncDecl, genCall string) *bodySegment {
+	var promptMarks []token.Pos
+	for _, cg := range file.Comments {
+		if cg.Pos() > fn.Body.Lbrace && cg.End() < fn.Body.Rbrace && strings.Contains(cg.Text(), "lx-prompt:") {
+			promptMarks = append(promptMarks, cg.Pos())
+		}
+	}
+
+	stmts := fn.Body.List
+	for i, stmt := range stmts {
+		if !stmtHasGenCall(fset, stmt, genCall) {
+			continue
+		}
+
+		boundary := fn.Body.Rbrace
+		for _, p := range promptMarks {
+			if p > stmt.End() && p < boundary {
+				boundary = p
+			}
+		}
+
+		j := i + 1
+		for j < len(stmts) && stmts[j].Pos() < boundary && !stmtHasGenCall(fset, stmts[j], "") {
+			j++
+		}
+		return &bodySegment{start: stmt.Pos(), end: stmts[j-1].End()}
+	}
+	return nil
+}
+
+func stmtHasGenCall(fset *token.FileSet, stmt ast.Stmt, genCall string) bool {
+	found := false
+	ast.Inspect(stmt, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && isLxGenCall(call) {
+			if genCall == "" || nodeToString(fset, call) == genCall {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+func extractLangStmts(fset *token.FileSet, fn *ast.FuncDecl) []string {
+	var stmts []string
+	beforeGen := true
+	for _, stmt := range fn.Body.List {
+		if beforeGen && hasLxGenCall(&ast.BlockStmt{List: []ast.Stmt{stmt}}) {
+			beforeGen = false
+		}
+		expr, ok := stmt.(*ast.ExprStmt)
+		if !ok {
+			continue
+		}
+		call, ok := expr.X.(*ast.CallExpr)
+		if !ok {
+			continue
+		}
+		// Preconditions before the first lx.Gen only reference parameters, so they survive the rewrite.
+		if isLxLangCall(call) || (beforeGen && isLxAssertCall(call)) {
+			stmts = append(stmts, nodeToString(fset, stmt))
+		}
+	}
+	return stmts
+}
+
+// locateGenTarget returns the current target file, the function, the segment to replace
+// (nil for the whole body) and the body with preserved lx statements prepended. The
+// caller holds the file lock. The parse from prepareGenJob is reused while the file is
+// unchanged; it is only parsed again after another target in it was written.
+func locateGenTarget(job *genJob, cleaned string) (*parsedFile, *ast.FuncDecl, *bodySegment, string, error) {
+	target := job.target
+	src, err := os.ReadFile(target.FilePath)
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("read failed: %w", err)
+	}
+
+	pf := job.parsed
+	if pf == nil || !bytes.Equal(pf.src, src) {
+		if pf, err = parseTargetFile(target.FilePath, src); err != nil {
+			return nil, nil, nil, "", fmt.Errorf("re-parse failed: %w", err)
+		}
+	}
+
+	fn := findFuncDecl(pf.node, target.FuncName, target.ReceiverType)
+
+	if fn == nil || fn.Body == nil {
+		return nil, nil, nil, "", errors.New("function not found during re-parse")
+	}
+
+	var seg *bodySegment
+	if target.Segmented {
+		if seg = findGenSegment(pf.fset, pf.node, fn, target.GenCall); seg == nil {
+			return nil, nil, nil, "", errors.New("lx.Gen call not found during re-parse")
+		}
+	} else if langStmts := extractLangStmts(pf.fset, fn); len(langStmts) > 0 {
+		cleaned = strings.Join(langStmts, "\n") + "\n" + cleaned
+	}
+
+	return pf, fn, seg, cleaned, nil
+}
+
+func applyCodeToFile(opts options, out io.Writer, path string, pf *parsedFile, fn *ast.FuncDecl, seg *bodySegment, marker, generated string, imports []string) error {
 
 	info, err := os.Stat(path)
 	if err != nil {
-		fmt.Printf("[lx] stat failed: %v\n", err)
-		return false
+		return fmt.Errorf("stat failed: %w", err)
 	}
 
-	src, err := os.ReadFile(path)
+	src := pf.src
+	newSrc, err := renderGeneratedSource(opts, path, pf, fn, seg, marker, generated, imports)
 	if err != nil {
-		fmt.Printf("[lx] read failed: %v\n", err)
-		return false
+		return err
+	}
+
+	if err := checkGeneratedSource(opts, path, newSrc); err != nil {
+		return err
+	}
+
+	if out != nil {
+		diff := unifiedDiff(path, string(src), string(newSrc), 3)
+		if diff != "" {
+			pendingChanges.Add(1)
+			diffMu.Lock()
+			fmt.Fprint(out, colorizeDiff(diff, out))
+			diffMu.Unlock()
+		}
+		return nil
+	}
+
+	if opts.interactive {
+		// An edited body is checked like a generated one. When it fails, the error is shown
+		// and the prompt repeats for the last change that passed; "e" reopens the failed edit.
+		editing := generated
+		for {
+			edited, err := confirmChange(path, src, newSrc, editing)
+			if err != nil {
+				return err
+			}
+			if edited == nil {
+				break
+			}
+			editing = *edited
+			editedSrc, err := renderGeneratedSource(opts, path, pf, fn, seg, marker, editing, imports)
+			if err == nil {
+				err = checkGeneratedSource(opts, path, editedSrc)
+			}
+			if err == nil {
+				newSrc = editedSrc
+				break
+			}
+			msg := err.Error()
+			var ce *lxerr.ErrCompileFailed
+			if errors.As(err, &ce) && ce.Output != "" {
+				msg = ce.Output
+			}
+			diffMu.Lock()
+			fmt.Printf("[lx] The edited body was not applied:\n%s\n", strings.TrimSpace(msg))
+			diffMu.Unlock()
+		}
+	}
+
+	if err := writeFileAtomic(path, newSrc, info.Mode()); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+
+	return nil
+}
+
+// checkGeneratedSource runs the compile check, and go vet, on newSrc in place of path unless
+// -skip-compile-check is set. A vet finding only fails the check with -strict-vet.
+func checkGeneratedSource(opts options, path string, newSrc []byte) error {
+	if opts.skipCompileCheck {
+		return nil
+	}
+	if out, err := checkCompiles(path, newSrc, opts.tags); err != nil {
+		return &lxerr.ErrCompileFailed{File: path, Output: out, Err: err}
+	}
+	if out, err := checkVet(path, newSrc, opts.tags); err != nil {
+		if opts.strictVet {
+			return &lxerr.ErrCompileFailed{File: path, Output: "go vet:\n" + out, Err: err}
+		}
+		logger.Warn("go vet warning", "file", path, "output", out)
 	}
+	return nil
+}
 
-	cleanPrompt := sanitizeComment(prompt)
-	finalBody := fmt.Sprintf("{\n\t// lx-prompt: %s\n\t%s\n}",
-		cleanPrompt,
+// renderGeneratedSource returns the formatted source of pf with the generated code spliced
+// in under marker (see promptMarker) and the lx.Import packages it uses imported. Nothing
+// is written.
+func renderGeneratedSource(opts options, path string, pf *parsedFile, fn *ast.FuncDecl, seg *bodySegment, marker, generated string, imports []string) ([]byte, error) {
+	src, fset := pf.src, pf.fset
+
+	marker = strings.ReplaceAll(marker, "\n", "\n\t")
+	finalBody := fmt.Sprintf("{\n\t%s\n\t%s\n}",
+		marker,
 		strings.ReplaceAll(generated, "\n", "\n\t"),
 	)
 
-	startOffset := fset.Position(fn.Body.Pos()).Offset
-	endOffset := fset.Position(fn.Body.End()).Offset
+	startPos, endPos := fn.Body.Pos(), fn.Body.End()
+	if seg != nil {
+		finalBody = fmt.Sprintf("%s\n\t%s",
+			marker,
+			strings.ReplaceAll(generated, "\n", "\n\t"),
+		)
+		startPos, endPos = seg.start, seg.end
+	}
+
+	startOffset := fset.Position(startPos).Offset
+	endOffset := fset.Position(endPos).Offset
 	if startOffset < 0 || endOffset < 0 || startOffset > len(src) || endOffset > len(src) || startOffset > endOffset {
-		fmt.Printf("[lx] invalid offsets for %s\n", path)
-		return false
+		return nil, fmt.Errorf("invalid offsets for %s", path)
 	}
 
 	newSrc := append([]byte{}, src[:startOffset]...)
 	newSrc = append(newSrc, []byte(finalBody)...)
 	newSrc = append(newSrc, src[endOffset:]...)
+	newSrc = dropUnusedLxImport(path, newSrc)
+	newSrc = addRequiredImports(path, newSrc, imports)
+
+	if formatted, out, err := formatSource(opts.formatter, path, newSrc); err == nil {
+		newSrc = formatted
+	} else if !opts.skipCompileCheck {
+		return nil, &lxerr.ErrCompileFailed{File: path, Output: out, Err: err}
+	} else {
+		logger.Warn("formatter failed", "formatter", opts.formatter, "err", err, "output", out)
+	}
+
+	return newSrc, nil
+}
+
+// promptMarker returns the comment written above generated code: the // lx-prompt: line,
+// followed by what lx clean needs to restore the original stub. // lx-gen: records the
+// lx.Gen call when it is not a plain lx.Gen("prompt") or the prompt includes lx.Hint texts.
+// When the whole body is replaced (whole), // lx-hint: and // lx-import: record the lx.Hint
+// and lx.Import statements that go with it.
+func promptMarker(target TargetInfo, prompt string, whole bool) string {
+	lines := []string{"// lx-prompt: " + sanitizeComment(prompt)}
+	if target.GenCall != "" && (len(target.Hints) > 0 || !isPlainGenCall(target.GenCall)) {
+		call := target.GenCall
+		if strings.Contains(call, "\n") {
+			call = strconv.Quote(call)
+		}
+		lines = append(lines, "// lx-gen: "+call)
+	}
+	if whole {
+		for _, hint := range target.Hints {
+			lines = append(lines, "// lx-hint: "+strconv.Quote(hint))
+		}
+		for _, pkg := range target.RequiredImports {
+			lines = append(lines, "// lx-import: "+strconv.Quote(pkg))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
 
-	if err := os.WriteFile(path, newSrc, info.Mode()); err != nil {
-		fmt.Printf("[lx] write failed: %v\n", err)
+// isPlainGenCall reports whether call is lx.Gen with a single string literal.
+func isPlainGenCall(call string) bool {
+	expr, err := parser.ParseExpr(call)
+	if err != nil {
+		return false
+	}
+	c, ok := expr.(*ast.CallExpr)
+	if !ok || !isLxCall(c, "Gen") || len(c.Args) != 1 {
 		return false
 	}
+	lit, ok := c.Args[0].(*ast.BasicLit)
+	return ok && lit.Kind == token.STRING
+}
+
+var pendingChanges atomic.Int32
+
+var (
+	errSkipped       = errors.New("skipped")
+	errSkippedByUser = fmt.Errorf("%w by user", errSkipped)
+)
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+func confirmChange(path string, before, after []byte, generated string) (*string, error) {
+	diffMu.Lock()
+	defer diffMu.Unlock()
+
+	fmt.Print(unifiedDiff(path, string(before), string(after), 3))
+
+	for {
+		fmt.Print("[lx] Apply this change? [y/n/e] ")
+		answer, err := stdinReader.ReadString('\n')
+		if err != nil && answer == "" {
+			return nil, errSkippedByUser
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return nil, nil
+		case "n", "no":
+			return nil, errSkippedByUser
+		case "e", "edit":
+			edited, err := editInEditor(generated)
+			if err != nil {
+				return nil, fmt.Errorf("editor failed: %w", err)
+			}
+			return &edited, nil
+		}
+	}
+}
+
+func editInEditor(content string) (string, error) {
+	editor := strings.TrimSpace(os.Getenv("EDITOR"))
+	if editor == "" {
+		editor = "vi"
+	}
+
+	f, err := os.CreateTemp("", "lx-edit-*.go")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], f.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\n"), nil
+}
+
+func formatSource(formatter, path string, src []byte) ([]byte, string, error) {
+	var args []string
+	if formatter == "goimports" {
+		args = append(args, "-srcdir", filepath.Dir(path))
+	}
+
+	cmd := exec.Command(formatter, args...)
+	cmd.Dir = filepath.Dir(path)
+	cmd.Stdin = bytes.NewReader(src)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, stderr.String(), err
+	}
+	return stdout.Bytes(), "", nil
+}
+
+// resolveFormatter returns the formatter named by the -formatter flag, else by the config,
+// else goimports. One that is not in PATH falls back to gofmt.
+func resolveFormatter(flagValue, configValue string) string {
+	name := strings.TrimSpace(flagValue)
+	if name == "" {
+		name = strings.TrimSpace(configValue)
+	}
+	if name == "" {
+		name = "goimports"
+	}
+	if _, err := exec.LookPath(name); err != nil {
+		logger.Warn("formatter not found in PATH, falling back to gofmt", "formatter", name)
+		return "gofmt"
+	}
+	return name
+}
+
+const lxImportPath = "github.com/chebread/lx"
+
+func dropUnusedLxImport(path string, src []byte) []byte {
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return src
+	}
+
+	for _, decl := range node.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			imp := spec.(*ast.ImportSpec)
+			if strings.Trim(imp.Path.Value, "\"`") != lxImportPath {
+				continue
+			}
+			name := "lx"
+			if imp.Name != nil {
+				name = imp.Name.Name
+			}
+			if name == "_" || name == "." || usesPackage(node, name) {
+				return src
+			}
+
+			var start, end int
+			if len(gen.Specs) == 1 {
+				start, end = fset.Position(gen.Pos()).Offset, fset.Position(gen.End()).Offset
+			} else {
+				start, end = fset.Position(imp.Pos()).Offset, fset.Position(imp.End()).Offset
+			}
+			out := append([]byte{}, src[:start]...)
+			return append(out, src[end:]...)
+		}
+	}
+	return src
+}
+
+// addRequiredImports adds each lx.Import path that src does not import yet, as long as the
+// file refers to it; an unused import would break the build.
+func addRequiredImports(path string, src []byte, imports []string) []byte {
+	if len(imports) == 0 {
+		return src
+	}
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return src
+	}
 
-	if err := runTool("gofmt", "-w", path); err != nil {
-		fmt.Printf("[lx] gofmt warning: %v\n", err)
+	added := false
+	for _, imp := range imports {
+		if hasImport(node, imp) {
+			continue
+		}
+		spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(imp)}}
+		if usesPackage(node, importName(spec)) {
+			addImport(node, imp)
+			added = true
+		}
+	}
+	if !added {
+		return src
 	}
 
-	return true
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, node); err != nil {
+		return src
+	}
+	return buf.Bytes()
+}
+
+func usesPackage(node *ast.File, name string) bool {
+	used := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return !used
+		}
+		if x, ok := sel.X.(*ast.Ident); ok && x.Name == name {
+			used = true
+		}
+		return !used
+	})
+	return used
+}
+
+func checkCompiles(path string, src []byte, tags string) (string, error) {
+	if strings.HasSuffix(path, "_test.go") {
+		return runGoWithOverlay(path, src, tags, "test", "-c", "-o", os.DevNull)
+	}
+	return runGoWithOverlay(path, src, tags, "build", "-o", os.DevNull)
+}
+
+func checkVet(path string, src []byte, tags string) (string, error) {
+	return runGoWithOverlay(path, src, tags, "vet")
+}
+
+func runGoWithOverlay(path string, src []byte, tags string, subcmd string, extra ...string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "lx-compile-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile := filepath.Join(tmpDir, filepath.Base(absPath))
+	if err := os.WriteFile(tmpFile, src, 0o600); err != nil {
+		return "", err
+	}
+
+	overlay, err := json.Marshal(map[string]map[string]string{
+		"Replace": {absPath: tmpFile},
+	})
+	if err != nil {
+		return "", err
+	}
+	overlayPath := filepath.Join(tmpDir, "overlay.json")
+	if err := os.WriteFile(overlayPath, overlay, 0o600); err != nil {
+		return "", err
+	}
+
+	args := []string{subcmd, "-overlay", overlayPath}
+	args = append(args, extra...)
+	if tags != "" {
+		args = append(args, "-tags", tags)
+	}
+	args = append(args, ".")
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = filepath.Dir(absPath)
+	out, err := cmd.CombinedOutput()
+
+	tmpRef := regexp.MustCompile(`\S*` + regexp.QuoteMeta(filepath.Base(tmpDir)+string(filepath.Separator)+filepath.Base(absPath)))
+	return tmpRef.ReplaceAllLiteralString(string(out), absPath), err
 }
 
 func extractDependencies(code string) []string {
@@ -239,10 +1577,3 @@ func extractDependencies(code string) []string {
 	}
 	return deps
 }
-
-func runTool(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chebread/lx/pkg/lxerr"
+)
+
+func TestStripCodeFence(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"go fence", "```go\nreturn 1\n```", "return 1\n"},
+		{"no language tag", "```\nreturn 1\n```\n", "return 1\n"},
+		{"other language tag", "```golang\nreturn 1\n```", "return 1\n"},
+		{"text around the fence", "Here is the body:\n```go\nreturn 1\n```\nIt returns one.", "return 1\n"},
+		{"indented closing fence", "```go\nreturn 1\n  ```\n", "return 1\n"},
+		{"unterminated fence", "```go\nreturn 1\n", "return 1\n"},
+		{"no fence", "return 1\n", "return 1\n"},
+	}
+	for _, tt := range tests {
+		if got := stripCodeFence(tt.in); got != tt.want {
+			t.Errorf("%s: stripCodeFence(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCleanAICode(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"go fence", "```go\nreturn a + b\n```", "return a + b"},
+		{"no language tag", "```\nreturn a + b\n```", "return a + b"},
+		{"other language tag", "```go1.22\nreturn a + b\n```", "return a + b"},
+		{"text around the fence", "Sure!\n```go\nsum := a + b\nreturn sum\n```\nDone.", "sum := a + b\nreturn sum"},
+		{"no fence", "return a + b", "return a + b"},
+		{"whole declaration", "```go\nfunc Add(a, b int) int {\n\treturn a + b\n}\n```", "\treturn a + b"},
+		{"interface{} parameter", "func F(v interface{}) (int, error) {\n\treturn 0, nil\n}", "\treturn 0, nil"},
+		{"struct{} parameter", "func F(done chan struct{}) {\n\t<-done\n}", "\t<-done"},
+		{"method", "func (r *Repo) Get(id int) (struct{ N int }, error) {\n\treturn struct{ N int }{id}, nil\n}", "\treturn struct{ N int }{id}, nil"},
+		{"bare braces", "{\n\treturn a + b\n}", "\treturn a + b"},
+		{"Gen call dropped", "lx.Gen(\"add\")\nreturn a + b", "return a + b"},
+		{"multi-line Lang call dropped", "lx.Lang(\"Add\", `\nif Add(1, 2) != 3 {\n\tpanic(\"Add\")\n}`)\nreturn a + b", "return a + b"},
+		{"Assert and MustCompile dropped", "lx.Assert(a >= 0, \"a is negative\"); lx.MustCompile(\"Add\")\nreturn a + b", "return a + b"},
+		{"mention of lx kept", "msg := \"see lx.Assert(\"\nlog.Print(msg)\nreturn a + b", "msg := \"see lx.Assert(\"\nlog.Print(msg)\nreturn a + b"},
+		{"unparsable body kept", "return a +", "return a +"},
+	}
+	for _, tt := range tests {
+		if got := cleanAICode(tt.in); got != tt.want {
+			t.Errorf("%s: cleanAICode(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolveFormatter(t *testing.T) {
+	// Only a fake goimports is in PATH.
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "goimports"), []byte("#!/bin/sh\ncat\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	tests := []struct {
+		flag, config string
+		want         string
+	}{
+		{"", "", "goimports"},
+		{"", "goimports", "goimports"},
+		{"goimports", "gofmt", "goimports"},
+		{"", "no-such-formatter", "gofmt"},
+		{"no-such-formatter", "goimports", "gofmt"},
+	}
+	for _, tt := range tests {
+		if got := resolveFormatter(tt.flag, tt.config); got != tt.want {
+			t.Errorf("resolveFormatter(%q, %q) = %q, want %q", tt.flag, tt.config, got, tt.want)
+		}
+	}
+}
+
+const unformattedSource = "package main\n\nfunc Shout(s string) string {\nreturn strings.ToUpper(s)\n}\n"
+
+func TestFormatSourceGoimports(t *testing.T) {
+	if _, err := exec.LookPath("goimports"); err != nil {
+		t.Skip("goimports not in PATH")
+	}
+	path := filepath.Join(t.TempDir(), "main.go")
+	out, msg, err := formatSource("goimports", path, []byte(unformattedSource))
+	if err != nil {
+		t.Fatalf("goimports: %v\n%s", err, msg)
+	}
+	if !strings.Contains(string(out), `import "strings"`) {
+		t.Errorf("missing import not added:\n%s", out)
+	}
+}
+
+func TestFormatSourceGofmt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	out, msg, err := formatSource("gofmt", path, []byte(unformattedSource))
+	if err != nil {
+		t.Fatalf("gofmt: %v\n%s", err, msg)
+	}
+	if !strings.Contains(string(out), "\n\treturn strings.ToUpper(s)\n") {
+		t.Errorf("body not indented:\n%s", out)
+	}
+	// gofmt leaves imports alone.
+	if strings.Contains(string(out), "import") {
+		t.Errorf("gofmt added an import:\n%s", out)
+	}
+}
+
+// panicLLM panics on every call, like a bug in a provider or the AST code would.
+type panicLLM struct{}
+
+func (panicLLM) Generate(ctx context.Context, model, prompt string) (string, error) {
+	panic("boom")
+}
+
+func (panicLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	panic("boom")
+}
+
+func (panicLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	panic("boom")
+}
+
+func TestProcessBatchPanic(t *testing.T) {
+	dir := t.TempDir()
+	src := "package main\n\nimport \"github.com/chebread/lx\"\n\nfunc A() int {\n\tlx.Gen(\"one\")\n\treturn 0\n}\n\nfunc B() int {\n\tlx.Gen(\"two\")\n\treturn 0\n}\n"
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	targets := scanProjectForLx(dir, pathFilter{})
+	fileLocks := map[string]*sync.Mutex{targets[0].FilePath: {}}
+
+	results := make(chan GenerationResult, 2*len(targets))
+	reported := make([]bool, len(targets))
+	func() {
+		defer recoverBatch(options{}, results, targets, reported, time.Now())
+		processBatch(options{genTimeout: time.Minute, minBodyLines: defaultMinBodyLines}, panicLLM{}, &Config{Model: "m"}, targets, reported, fileLocks, results)
+	}()
+	close(results)
+
+	var got []string
+	for r := range results {
+		if !strings.Contains(r.Error, "generation panicked: boom") {
+			t.Errorf("%s: error = %q, want the panic", r.FuncName, r.Error)
+		}
+		got = append(got, r.FuncName)
+	}
+	if len(got) != 2 {
+		t.Errorf("results for %v, want one each for A and B", got)
+	}
+}
+
+func TestRecoverBatchSkipsReported(t *testing.T) {
+	results := make(chan GenerationResult, 2)
+	targets := []TargetInfo{{FuncName: "A"}, {FuncName: "B"}}
+	func() {
+		defer recoverBatch(options{}, results, targets, []bool{true, false}, time.Now())
+		panic("boom")
+	}()
+	close(results)
+
+	var got []string
+	for r := range results {
+		got = append(got, r.FuncName)
+	}
+	if len(got) != 1 || got[0] != "B" {
+		t.Errorf("results for %v, want only B", got)
+	}
+}
+
+func TestMustCompileOverridesSkip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	original := "package main\n\nfunc F() int {\n\treturn 0\n}\n\nfunc main() {}\n"
+	for name, src := range map[string]string{"go.mod": "module example.com/m\n\ngo 1.25\n", "main.go": original} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := options{skipCompileCheck: true, formatter: "gofmt"}
+	job := &genJob{target: TargetInfo{FilePath: path, FuncName: "F", MustCompile: true}, prompt: "one"}
+
+	err := writeGeneratedBody(opts, job, `return "one"`, &sync.Mutex{})
+	var ce *lxerr.ErrCompileFailed
+	if !errors.As(err, &ce) {
+		t.Fatalf("err = %v, want ErrCompileFailed", err)
+	}
+	assertFile(t, path, original)
+
+	if err := writeGeneratedBody(opts, job, "return 1", &sync.Mutex{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !strings.Contains(string(got), "\treturn 1\n") {
+		t.Errorf("body not written:\n%s", got)
+	}
+}
+
+func TestInteractiveEditIsCompileChecked(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	original := "package main\n\nfunc F() int {\n\treturn 0\n}\n\nfunc main() {}\n"
+	for name, src := range map[string]string{"go.mod": "module example.com/m\n\ngo 1.25\n", "main.go": original} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first edit does not build, the second one does.
+	editor := filepath.Join(dir, "editor.sh")
+	script := "#!/bin/sh\nif [ -e " + dir + "/edited ]; then echo 'return 2' > \"$1\"; else touch " + dir + "/edited; echo 'return \"two\"' > \"$1\"; fi\n"
+	if err := os.WriteFile(editor, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EDITOR", editor)
+	saved := stdinReader
+	defer func() { stdinReader = saved }()
+	stdinReader = bufio.NewReader(strings.NewReader("e\ne\n"))
+
+	opts := options{interactive: true, formatter: "gofmt"}
+	job := &genJob{target: TargetInfo{FilePath: path, FuncName: "F"}, prompt: "two"}
+	if err := writeGeneratedBody(opts, job, "return 1", &sync.Mutex{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !strings.Contains(string(got), "\treturn 2\n") {
+		t.Errorf("second edit not applied:\n%s", got)
+	}
+}
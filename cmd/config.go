@@ -3,38 +3,178 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"go/token"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/chebread/lx/pkg/lxerr"
 	"gopkg.in/yaml.v3"
 )
 
 type options struct {
 	targetDir      string
 	timeout        time.Duration
+	genTimeout     time.Duration
 	showStdout     bool
 	maxPromptChars int
 	maxBodyChars   int
 	maxOutputBytes int
 	tags           string
+	explain        bool
+	maxTurns       int
+	funcsPerCall   int
+
+	skipCompileCheck  bool
+	maxRetries        int
+	formatter         string
+	interactive       bool
+	dryRun            bool
+	only              string
+	exclude           string
+	cacheDir          string
+	cacheTTL          time.Duration
+	temperature       float64
+	topP              float64
+	llmRetries        int
+	parallelism       int
+	strictVet         bool
+	testMode          bool
+	testRun           string
+	saveTraces        bool
+	loadTraces        string
+	watch             bool
+	genTests          bool
+	verify            bool
+	minBodyLines      int
+	force             bool
+	regen             bool
+	includeCallers    bool
+	candidates        int
+	autoDeps          bool
+	outputJSON        string
+	ci                bool
+	githubAnnotations bool
+	requestsPerMinute int
+	excludeFiles      string
+	excludeDirs       string
+	filter            pathFilter
+	dedupTraces       bool
+	buildBinary       bool
+	binary            string
+	runArgs           string
+	runArgv           []string
+	stdinFixture      string
+	stdinText         string
+	stdinData         []byte
+	contextLines      int
+	contextDepth      int
+	logLevel          string
+	logFormat         string
+	profileCPU        string
+	profileMem        string
+	skipRevert        bool
+	maxTracesPerFunc  int
+	otel              bool
+	costLimit         float64
+	noSpy             bool
+	simulate          bool
+	initSafe          bool
+	yes               bool
+	sanitizePrompt    bool
+	sanitizers        []*regexp.Regexp
+	maxTargets        int
+	ipcSocket         string
 }
 
 type Config struct {
-	Provider string   `yaml:"provider"`
-	ApiKey   string   `yaml:"api_key"`
-	Model    string   `yaml:"model"`
-	BinPath  string   `yaml:"bin_path"`
-	Args     []string `yaml:"args"`
+	Provider  string   `yaml:"provider" toml:"provider"`
+	ApiKey    string   `yaml:"api_key" toml:"api_key"`
+	Model     string   `yaml:"model" toml:"model"`
+	BaseURL   string   `yaml:"base_url" toml:"base_url"`
+	BinPath   string   `yaml:"bin_path" toml:"bin_path"`
+	Args      []string `yaml:"args" toml:"args"`
+	Formatter string   `yaml:"formatter" toml:"formatter"`
+
+	// PromptTemplate is a text/template that replaces the per-function part of the prompt.
+	PromptTemplate string `yaml:"prompt_template" toml:"prompt_template"`
+
+	// SystemRole and UserRole are text/templates for the system and user messages. Setting
+	// either sends the prompt as two messages: rules in the system role, the task in the user role.
+	SystemRole string `yaml:"system_role" toml:"system_role"`
+	UserRole   string `yaml:"user_role" toml:"user_role"`
+
+	// SanitizePatterns are the regexps -sanitize-prompt masks; empty uses defaultSanitizePatterns.
+	SanitizePatterns []string `yaml:"sanitize_patterns" toml:"sanitize_patterns"`
+
+	// ExcludeDirs are the directory name globs never scanned or instrumented; nil uses
+	// defaultExcludeDirs. -exclude-dirs adds to them.
+	ExcludeDirs []string `yaml:"exclude_dirs" toml:"exclude_dirs"`
+
+	Temperature *float32 `yaml:"temperature" toml:"temperature"`
+	TopP        *float32 `yaml:"top_p" toml:"top_p"`
+
+	ResourceName string `yaml:"resource_name" toml:"resource_name"`
+	DeploymentID string `yaml:"deployment_id" toml:"deployment_id"`
+	APIVersion   string `yaml:"api_version" toml:"api_version"`
+
+	CostPer1kInput  *float64 `yaml:"cost_per_1k_input" toml:"cost_per_1k_input"`
+	CostPer1kOutput *float64 `yaml:"cost_per_1k_output" toml:"cost_per_1k_output"`
+
+	RequestsPerMinute int `yaml:"-" toml:"-"`
 }
 
 type TargetInfo struct {
-	FilePath string
-	FuncName string
-	Prompt   string
-	Output   string
+	FilePath     string
+	FuncName     string
+	ReceiverType string
+
+	// PromptIndex is the position of this lx.Gen call among the calls in the
+	// function; Segmented is set when the function holds more than one call,
+	// in which case only the statements from this call up to the next lx.Gen
+	// are replaced. CallPos is relative to the FileSet used by the scan.
+	PromptIndex     int
+	CallPos         token.Pos
+	CallLine        int
+	GenCall         string
+	Segmented       bool
+	Prompt          string
+	Hints           []string // lx.Hint texts of the function, already appended to Prompt
+	RequiredImports []string // lx.Import paths of the function
+	Condition       string
+	FileConfig      map[string]string
+	Output          string
+	OutputCalls     int    // set when Output is a JSON array of every lx.SpyMulti value
+	CallArgs        string // JSON array of the value arguments of a void function, from lx.SpyVoidArgs
+	Examples        []string
+	ExamplePairs    []ExamplePair
+	MustCompile     bool
+	Generated       bool
+	Timeout         time.Duration
+	// CalledTargets are the other targets this function calls. buildDependencyGraph sets
+	// them and schedules them first, so the prompt can show their generated bodies.
+	CalledTargets []TargetInfo
+}
+
+// ExamplePair is an lx.GenWithExamples pair, as Go source or JSON text.
+type ExamplePair struct {
+	Input  string
+	Output string
+}
+
+// GenerationResult is one entry of the -output-json summary.
+type GenerationResult struct {
+	FilePath       string `json:"file_path"`
+	FuncName       string `json:"func_name"`
+	Status         string `json:"status"`
+	Error          string `json:"error,omitempty"`
+	LinesGenerated int    `json:"lines_generated"`
+	DurationMs     int64  `json:"duration_ms"`
 }
 
 type TraceData struct {
@@ -48,38 +188,130 @@ type TraceData struct {
 type fileBackup struct {
 	Data []byte
 	Mode fs.FileMode
+
+	// GenLines maps lx.Gen call lines in the instrumented file back to the original source.
+	GenLines map[int]int
 }
 
 func loadConfig() (*Config, string, error) {
-	localPath := "lx-config.yaml"
-	if _, err := os.Stat(localPath); err == nil {
-		data, err := os.ReadFile(localPath)
+	candidates := []struct {
+		path  string
+		label string
+	}{
+		{configFileName, "Local"},
+		{configFileNameTOML, "Local"},
+	}
+
+	home, err := os.UserHomeDir()
+	if err == nil {
+		candidates = append(candidates,
+			struct{ path, label string }{filepath.Join(home, configFileName), "Global"},
+			struct{ path, label string }{filepath.Join(home, configFileNameTOML), "Global"},
+		)
+	}
+
+	for _, c := range candidates {
+		if _, err := os.Stat(c.path); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(c.path)
 		if err != nil {
 			return nil, "", err
 		}
-		var cfg Config
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return nil, "", err
+		ext := filepath.Ext(c.path)
+		cfg, err := parseConfigFile(data, ext)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", c.path, err)
 		}
-		return &cfg, "./lx-config.yaml [Local]", nil
+		applyEnvOverrides(cfg)
+
+		displayPath := "./" + c.path
+		if c.label == "Global" {
+			displayPath = strings.Replace(c.path, home, "~", 1)
+		}
+		if ext == ".toml" {
+			return cfg, fmt.Sprintf("%s [%s, TOML]", displayPath, c.label), nil
+		}
+		return cfg, fmt.Sprintf("%s [%s]", displayPath, c.label), nil
 	}
 
-	home, err := os.UserHomeDir()
-	if err == nil {
-		globalPath := filepath.Join(home, "lx-config.yaml")
-		if _, err := os.Stat(globalPath); err == nil {
-			data, err := os.ReadFile(globalPath)
-			if err != nil {
-				return nil, "", err
-			}
-			var cfg Config
-			if err := yaml.Unmarshal(data, &cfg); err != nil {
-				return nil, "", err
-			}
-			displayPath := strings.Replace(globalPath, home, "~", 1)
-			return &cfg, fmt.Sprintf("%s [Global]", displayPath), nil
+	var cfg Config
+	if applyEnvOverrides(&cfg) > 0 {
+		return &cfg, "environment variables [Env]", nil
+	}
+
+	searched := make([]string, len(candidates))
+	for i, c := range candidates {
+		searched[i] = c.path
+	}
+	return nil, "", &lxerr.ErrConfigNotFound{SearchedPaths: searched}
+}
+
+func applyEnvOverrides(cfg *Config) int {
+	overrides := []struct {
+		env    string
+		field  string
+		dst    *string
+		secret bool
+	}{
+		{"LX_PROVIDER", "provider", &cfg.Provider, false},
+		{"LX_API_KEY", "api_key", &cfg.ApiKey, true},
+		{"LX_MODEL", "model", &cfg.Model, false},
+		{"LX_BIN_PATH", "bin_path", &cfg.BinPath, false},
+		{"LX_BASE_URL", "base_url", &cfg.BaseURL, false},
+		{"LX_FORMATTER", "formatter", &cfg.Formatter, false},
+		{"LX_RESOURCE_NAME", "resource_name", &cfg.ResourceName, false},
+		{"LX_DEPLOYMENT_ID", "deployment_id", &cfg.DeploymentID, false},
+		{"LX_API_VERSION", "api_version", &cfg.APIVersion, false},
+	}
+
+	count := 0
+	for _, o := range overrides {
+		val, ok := os.LookupEnv(o.env)
+		if !ok || strings.TrimSpace(val) == "" {
+			continue
 		}
+		*o.dst = strings.TrimSpace(val)
+		count++
+
+		shown := *o.dst
+		if o.secret {
+			shown = "[REDACTED]"
+		}
+		logger.Info("Config override", "env", o.env, "field", o.field, "value", shown)
 	}
+	return count
+}
 
-	return nil, "", fmt.Errorf("could not find 'lx-config.yaml' file")
+func parseConfigFile(data []byte, ext string) (*Config, error) {
+	var cfg Config
+	switch strings.ToLower(ext) {
+	case ".toml":
+		if err := toml.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+	default:
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	templates := []struct{ key, text string }{
+		{"prompt_template", cfg.PromptTemplate},
+		{"system_role", cfg.SystemRole},
+		{"user_role", cfg.UserRole},
+	}
+	for _, t := range templates {
+		if _, err := template.New(t.key).Parse(t.text); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.key, err)
+		}
+	}
+	if _, err := compileSanitizePatterns(cfg.SanitizePatterns); err != nil {
+		return nil, err
+	}
+	for _, p := range cfg.ExcludeDirs {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("exclude_dirs: bad pattern %q: %w", p, err)
+		}
+	}
+	return &cfg, nil
 }
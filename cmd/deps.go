@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// installedDeps tracks go get results per module directory so retries and sibling
+// functions do not fetch the same package twice, and records which modules need tidying.
+var installedDeps = struct {
+	sync.Mutex
+	done map[string]bool
+	dirs map[string]bool
+}{done: map[string]bool{}, dirs: map[string]bool{}}
+
+func installDependencies(opts options, taskName, dir string, deps []string) {
+	for _, dep := range uniqueStrings(deps) {
+		key := dir + "\n" + dep
+
+		installedDeps.Lock()
+		if _, seen := installedDeps.done[key]; seen {
+			installedDeps.Unlock()
+			continue
+		}
+		installedDeps.done[key] = true
+		installedDeps.Unlock()
+
+		if opts.dryRun {
+			logger.Info("would run go get", "task", taskName, "dep", dep, "dir", dir)
+			continue
+		}
+
+		start := time.Now()
+		cmd := exec.Command("go", "get", dep)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+
+		if err != nil {
+			logger.Warn("go get failed", "task", taskName, "dep", dep, "err", err, "output", strings.TrimSpace(string(out)))
+		} else {
+			logger.Info("go get", "task", taskName, "dep", dep, "elapsed", time.Since(start).Round(time.Millisecond))
+		}
+
+		if err == nil {
+			installedDeps.Lock()
+			installedDeps.dirs[dir] = true
+			installedDeps.Unlock()
+		}
+	}
+}
+
+// tidyModules runs go mod tidy once in every directory where go get succeeded.
+func tidyModules() {
+	installedDeps.Lock()
+	defer installedDeps.Unlock()
+
+	for dir := range installedDeps.dirs {
+		cmd := exec.Command("go", "mod", "tidy")
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			logger.Warn("go mod tidy failed", "dir", dir, "err", err, "output", strings.TrimSpace(string(out)))
+		} else {
+			logger.Info("go mod tidy", "dir", dir)
+		}
+	}
+	clear(installedDeps.dirs)
+}
+
+// ensureLxModule checks that the module holding root requires the lx package, which the
+// instrumented sources import. If go.mod lacks it, go get is run once the user agrees, or
+// right away with -yes.
+func ensureLxModule(root string, assumeYes bool) error {
+	modPath := findGoMod(root)
+	if modPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(modPath)
+	if err != nil {
+		return err
+	}
+	if goModMentions(data, lxImportPath) {
+		return nil
+	}
+
+	if !assumeYes {
+		question := fmt.Sprintf("[lx] %s does not require %s. Run go get %s now? [y/N] ", modPath, lxImportPath, lxImportPath)
+		if !askYesNo(bufio.NewScanner(os.Stdin), os.Stdout, question) {
+			return fmt.Errorf("%s does not require %s; run go get %s or pass -yes", modPath, lxImportPath, lxImportPath)
+		}
+	}
+
+	cmd := exec.Command("go", "get", lxImportPath)
+	cmd.Dir = filepath.Dir(modPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("go get %s failed: %w\n%s", lxImportPath, err, strings.TrimSpace(string(out)))
+	}
+	logger.Info("The lx package was missing, so go get added it; go.mod and go.sum were modified", "file", modPath)
+	return nil
+}
+
+// findGoMod returns the go.mod of the module containing dir, or "" if there is none.
+func findGoMod(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, "go.mod")
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// goModMentions reports whether a go.mod declares or requires the module path.
+func goModMentions(data []byte, path string) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "require" || fields[0] == "module") {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && fields[0] == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type diffOp struct {
+	kind byte
+	line string
+}
+
+func unifiedDiff(name, before, after string, context int) string {
+	ops := diffLines(splitLines(before), splitLines(after))
+
+	var changes []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	oldPos := make([]int, len(ops)+1)
+	newPos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldPos[i+1], newPos[i+1] = oldPos[i], newPos[i]
+		if op.kind != '+' {
+			oldPos[i+1]++
+		}
+		if op.kind != '-' {
+			newPos[i+1]++
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", name, name)
+
+	for k := 0; k < len(changes); {
+		start := max(changes[k]-context, 0)
+		last := changes[k]
+		k++
+		for k < len(changes) && changes[k]-last <= 2*context {
+			last = changes[k]
+			k++
+		}
+		end := min(last+context+1, len(ops))
+
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n",
+			oldPos[start]+1, oldPos[end]-oldPos[start],
+			newPos[start]+1, newPos[end]-newPos[start],
+		)
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+	}
+
+	return sb.String()
+}
+
+func diffLines(a, b []string) []diffOp {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	am, bm := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	n, m := len(am), len(bm)
+
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case am[i] == bm[j]:
+			ops = append(ops, diffOp{' ', am[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', am[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', bm[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{'-', am[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{'+', bm[j]})
+	}
+
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+func colorizeDiff(diff string, w io.Writer) string {
+	if !supportsColor(w) {
+		return diff
+	}
+
+	lines := strings.SplitAfter(diff, "\n")
+	for i, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "+++"), strings.HasPrefix(l, "---"):
+		case strings.HasPrefix(l, "+"):
+			lines[i] = "\x1b[32m" + strings.TrimSuffix(l, "\n") + "\x1b[0m\n"
+		case strings.HasPrefix(l, "-"):
+			lines[i] = "\x1b[31m" + strings.TrimSuffix(l, "\n") + "\x1b[0m\n"
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func supportsColor(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && isTerminal(f)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
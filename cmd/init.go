@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	configFileName     = "lx-config.yaml"
+	configFileNameTOML = "lx-config.toml"
+)
+
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	provider := fs.String("provider", "", "LLM provider (gemini, openai, anthropic, azure-openai, ollama, command)")
+	model := fs.String("model", "", "Model name")
+	key := fs.String("key", "", "API key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+
+	if _, err := os.Stat(configFileName); err == nil {
+		if !askYesNo(in, os.Stdout, fmt.Sprintf("[lx] %s already exists. Overwrite? [y/N] ", configFileName)) {
+			logger.Info("Init cancelled")
+			return nil
+		}
+	}
+
+	cfg := Config{
+		Provider: strings.TrimSpace(*provider),
+		Model:    strings.TrimSpace(*model),
+		ApiKey:   strings.TrimSpace(*key),
+	}
+
+	if cfg.Provider == "" {
+		cfg.Provider = ask(in, os.Stdout, "Provider [gemini]: ", "gemini")
+	}
+	cfg.Provider = strings.ToLower(cfg.Provider)
+
+	if cfg.Model == "" {
+		cfg.Model = ask(in, os.Stdout, "Model: ", "")
+	}
+
+	switch cfg.Provider {
+	case "ollama":
+	case "command":
+		cfg.BinPath = ask(in, os.Stdout, "bin_path: ", "")
+	default:
+		if cfg.ApiKey == "" {
+			cfg.ApiKey = ask(in, os.Stdout, "API key: ", "")
+		}
+	}
+
+	if err := validateInitConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(configFileName, []byte(renderConfigTemplate(cfg)), 0o600); err != nil {
+		return err
+	}
+
+	logger.Info("Wrote config", "path", "./"+configFileName)
+	logger.Warn("Remember to add the config to your .gitignore so your API key is not committed", "path", configFileName)
+	return nil
+}
+
+func validateInitConfig(cfg Config) error {
+	if cfg.Provider == "" {
+		return errors.New("provider is required")
+	}
+	if cfg.Model == "" {
+		return errors.New("model is required")
+	}
+	switch cfg.Provider {
+	case "ollama":
+	case "command":
+		if cfg.BinPath == "" {
+			return errors.New("bin_path is required for the command provider")
+		}
+	default:
+		if cfg.ApiKey == "" {
+			return fmt.Errorf("api_key is required for the %s provider", cfg.Provider)
+		}
+	}
+	return nil
+}
+
+func renderConfigTemplate(cfg Config) string {
+	var sb strings.Builder
+	sb.WriteString("# lx configuration. Keep this file out of version control.\n")
+	fmt.Fprintf(&sb, "provider: %s\n", strconv.Quote(cfg.Provider))
+	fmt.Fprintf(&sb, "model: %s\n", strconv.Quote(cfg.Model))
+	if cfg.ApiKey != "" {
+		fmt.Fprintf(&sb, "api_key: %s\n", strconv.Quote(cfg.ApiKey))
+	}
+	sb.WriteString("# Sampling (optional). Lower temperature gives more deterministic code.\n")
+	sb.WriteString("# temperature: 0.2\n")
+	sb.WriteString("# top_p: 0.95\n")
+	if cfg.BinPath != "" {
+		fmt.Fprintf(&sb, "bin_path: %s\n", strconv.Quote(cfg.BinPath))
+		sb.WriteString("args:\n  - \"-p\"\n  - \"{{prompt}}\"\n  - \"-m\"\n  - \"{{model}}\"\n")
+	}
+	return sb.String()
+}
+
+func ask(in *bufio.Scanner, out io.Writer, label, def string) string {
+	fmt.Fprint(out, label)
+	if !in.Scan() {
+		return def
+	}
+	if v := strings.TrimSpace(in.Text()); v != "" {
+		return v
+	}
+	return def
+}
+
+func askYesNo(in *bufio.Scanner, out io.Writer, label string) bool {
+	switch strings.ToLower(ask(in, out, label, "n")) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
@@ -4,19 +4,22 @@ import (
 	"bytes"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/format"
 	"go/parser"
 	"go/token"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
-func injectSpyCode(root string) (map[string]fileBackup, error) {
+func injectSpyCode(root string, filter pathFilter, tags string, initSafe bool, selected func(path, name, recv string) bool) (map[string]fileBackup, error) {
 	backups := make(map[string]fileBackup)
+	instrumented := make(map[string][]byte)
 
-	err := walkGoFiles(root, func(path string, d fs.DirEntry) error {
+	err := walkGoFiles(root, filter, func(path string, d fs.DirEntry) error {
 
 		if d.Type()&os.ModeSymlink != 0 {
 			return nil
@@ -40,20 +43,21 @@ func injectSpyCode(root string) (map[string]fileBackup, error) {
 
 		modified := false
 
-		ast.Inspect(node, func(n ast.Node) bool {
-			fn, ok := n.(*ast.FuncDecl)
-			if !ok {
-				return true
+		for _, fn := range funcDecls(node) {
+			if fn.Body == nil || !hasLxGenCall(fn.Body) {
+				continue
 			}
-			if fn.Body == nil {
-				return true
+
+			if selected != nil && !selected(path, fn.Name.Name, receiverType(fn)) {
+				continue
 			}
 
-			if !hasLxGenCall(fn.Body) {
-				return true
+			if initSafe && makeStubSafe(fset, fn) {
+				modified = true
 			}
 
 			var returnTypes []ast.Expr
+			var namedResults []*ast.Ident
 			if fn.Type.Results != nil {
 				for _, field := range fn.Type.Results.List {
 					count := len(field.Names)
@@ -63,12 +67,28 @@ func injectSpyCode(root string) (map[string]fileBackup, error) {
 					for i := 0; i < count; i++ {
 						returnTypes = append(returnTypes, field.Type)
 					}
+					namedResults = append(namedResults, field.Names...)
 				}
 			}
 
+			spyName := qualifiedFuncName(fn.Name.Name, receiverType(fn))
+			ctxParam := genCtxParam(fn)
 			isVoid := len(returnTypes) == 0
 
-			if isVoid {
+			captured, args := sideEffectParams(fn), valueParams(fn)
+			if isVoid && len(captured)+len(args) > 0 {
+				// Both spies can apply: pointer, slice and map parameters are recorded after
+				// the call, the other arguments as they were passed in.
+				var spies []ast.Stmt
+				if len(captured) > 0 {
+					spies = append(spies, newSpyCaptureDefer(spyName, captured))
+				}
+				if len(args) > 0 {
+					spies = append(spies, newSpyVoidArgsDefer(spyName, args))
+				}
+				fn.Body.List = append(spies, fn.Body.List...)
+				modified = true
+			} else if isVoid {
 				deferStmt := &ast.DeferStmt{
 					Call: &ast.CallExpr{
 						Fun: &ast.SelectorExpr{
@@ -78,15 +98,41 @@ func injectSpyCode(root string) (map[string]fileBackup, error) {
 						Args: []ast.Expr{
 							&ast.BasicLit{
 								Kind:  token.STRING,
-								Value: fmt.Sprintf("%q", fn.Name.Name),
+								Value: fmt.Sprintf("%q", spyName),
 							},
 						},
 					},
 				}
 				fn.Body.List = append([]ast.Stmt{deferStmt}, fn.Body.List...)
 				modified = true
+			} else if len(namedResults) > 0 && hasBareReturn(fn.Body) {
+				var spyStmts []ast.Stmt
+				for i, ident := range namedResults {
+					if ident.Name == "_" {
+						continue
+					}
+					spyStmts = append(spyStmts, &ast.ExprStmt{
+						X: withSpyCtx(newSpyCall(spyName, returnTypes[i], ast.NewIdent(ident.Name)), ctxParam),
+					})
+				}
+				if len(spyStmts) > 0 {
+					deferStmt := &ast.DeferStmt{
+						Call: &ast.CallExpr{
+							Fun: &ast.FuncLit{
+								Type: &ast.FuncType{Params: &ast.FieldList{}},
+								Body: &ast.BlockStmt{List: spyStmts},
+							},
+						},
+					}
+					fn.Body.List = append([]ast.Stmt{deferStmt}, fn.Body.List...)
+					modified = true
+				}
 			} else {
+				litBodies := funcLitBodies(fn.Body)
 				ast.Inspect(fn.Body, func(inner ast.Node) bool {
+					if lit, ok := inner.(*ast.FuncLit); ok && litBodies[lit.Body] {
+						return false
+					}
 					retStmt, ok := inner.(*ast.ReturnStmt)
 					if !ok {
 						return true
@@ -97,97 +143,542 @@ func injectSpyCode(root string) (map[string]fileBackup, error) {
 							continue
 						}
 
-						spySelector := &ast.SelectorExpr{
-							X:   ast.NewIdent("lx"),
-							Sel: ast.NewIdent("Spy"),
-						}
-
-						spyInstance := &ast.IndexExpr{
-							X:     spySelector,
-							Index: returnTypes[i],
-						}
-
-						spyCall := &ast.CallExpr{
-							Fun: spyInstance,
-							Args: []ast.Expr{
-								&ast.BasicLit{
-									Kind:  token.STRING,
-									Value: fmt.Sprintf("%q", fn.Name.Name),
-								},
-								resultExpr,
-							},
-						}
-						retStmt.Results[i] = spyCall
+						retStmt.Results[i] = withSpyCtx(newSpyCall(spyName, returnTypes[i], resultExpr), ctxParam)
 						modified = true
 					}
 					return true
 				})
 			}
-
-			return true
-		})
+		}
 
 		if !modified {
 			return nil
 		}
 
-		backups[path] = fileBackup{Data: src, Mode: info.Mode()}
+		origLines := genCallLines(fset, node)
 
 		var buf bytes.Buffer
 		if err := format.Node(&buf, fset, node); err != nil {
 			return err
 		}
 
-		if err := os.WriteFile(path, buf.Bytes(), info.Mode()); err != nil {
-			return err
+		backup := fileBackup{Data: src, Mode: info.Mode()}
+		newFset := token.NewFileSet()
+		if newNode, err := parser.ParseFile(newFset, path, buf.Bytes(), 0); err == nil {
+			if newLines := genCallLines(newFset, newNode); len(newLines) == len(origLines) {
+				backup.GenLines = make(map[int]int, len(newLines))
+				for i, l := range newLines {
+					backup.GenLines[l] = origLines[i]
+				}
+			}
 		}
+		backups[path] = backup
+		instrumented[path] = buf.Bytes()
 
 		return nil
 	})
+	if err != nil || len(instrumented) == 0 {
+		return backups, err
+	}
 
-	return backups, err
+	for path, funcs := range findSpyTypeErrors(instrumented, tags) {
+		logger.Warn("spy instrumentation does not type-check; capturing that file uninstrumented", "file", path, "funcs", strings.Join(funcs, ", "))
+		delete(instrumented, path)
+		delete(backups, path)
+	}
+	if len(instrumented) == 0 {
+		return backups, nil
+	}
+
+	// Persist the originals before touching any file so `lx rollback` can recover from SIGKILL.
+	if err := saveBackupFile(root, backups); err != nil {
+		return nil, fmt.Errorf("save %s: %w", backupFileName, err)
+	}
+
+	written := make(map[string]fileBackup, len(instrumented))
+	for path, src := range instrumented {
+		if err := writeFileAtomic(path, src, backups[path].Mode); err != nil {
+			return written, err
+		}
+		written[path] = backups[path]
+	}
+
+	return backups, nil
+}
+
+// importName is the name an import is referred to by: its explicit name, or the last path
+// element without a major version suffix or "go-" prefix.
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	p, _ := strconv.Unquote(spec.Path.Value)
+	parts := strings.Split(p, "/")
+	name := parts[len(parts)-1]
+	if len(parts) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = parts[len(parts)-2]
+	}
+	if i := strings.Index(name, ".v"); i > 0 {
+		name = name[:i]
+	}
+	return strings.TrimPrefix(name, "go-")
+}
+
+func addImport(file *ast.File, path string) {
+	spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(path)}}
+	file.Imports = append(file.Imports, spec)
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			if !gen.Lparen.IsValid() {
+				gen.Lparen = gen.Pos()
+				gen.Rparen = gen.End()
+			}
+			gen.Specs = append(gen.Specs, spec)
+			return
+		}
+	}
+	file.Decls = append([]ast.Decl{&ast.GenDecl{Tok: token.IMPORT, Specs: []ast.Spec{spec}}}, file.Decls...)
+}
+
+// sideEffectParams returns the named pointer, slice and map parameters of fn, whose contents
+// a void function may leave changed for its caller. Channels are skipped: reading them would
+// consume values.
+func sideEffectParams(fn *ast.FuncDecl) []*ast.Ident {
+	var params []*ast.Ident
+	for _, field := range fn.Type.Params.List {
+		switch t := field.Type.(type) {
+		case *ast.StarExpr, *ast.MapType, *ast.Ellipsis:
+		case *ast.ArrayType:
+			if t.Len != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		for _, name := range field.Names {
+			if name.Name != "_" {
+				params = append(params, name)
+			}
+		}
+	}
+	return params
+}
+
+// valueParams returns the named parameters of fn that sideEffectParams leaves out, in order.
+// Channels and functions are skipped too, as they have no value to record.
+func valueParams(fn *ast.FuncDecl) []*ast.Ident {
+	side := make(map[*ast.Ident]bool)
+	for _, p := range sideEffectParams(fn) {
+		side[p] = true
+	}
+	var params []*ast.Ident
+	for _, field := range fn.Type.Params.List {
+		switch field.Type.(type) {
+		case *ast.ChanType, *ast.FuncType:
+			continue
+		}
+		for _, name := range field.Names {
+			if name.Name != "_" && !side[name] {
+				params = append(params, name)
+			}
+		}
+	}
+	return params
+}
+
+// newSpyVoidArgsDefer builds
+//
+//	defer lx.SpyVoidArgs("F", p1, p2, ...)
+//
+// whose arguments are evaluated on entry, so the trace holds the inputs of the call.
+func newSpyVoidArgsDefer(funcName string, params []*ast.Ident) *ast.DeferStmt {
+	args := []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", funcName)}}
+	for _, p := range params {
+		args = append(args, ast.NewIdent(p.Name))
+	}
+	return &ast.DeferStmt{
+		Call: &ast.CallExpr{
+			Fun:  &ast.SelectorExpr{X: ast.NewIdent("lx"), Sel: ast.NewIdent("SpyVoidArgs")},
+			Args: args,
+		},
+	}
+}
+
+// newSpyCaptureDefer builds
+//
+//	defer func() { lx.SpyCapture("F", map[string]interface{}{"p": p, ...}) }()
+//
+// so the parameters are read when the function returns, not when the defer is registered.
+func newSpyCaptureDefer(funcName string, params []*ast.Ident) *ast.DeferStmt {
+	elts := make([]ast.Expr, 0, len(params))
+	for _, p := range params {
+		elts = append(elts, &ast.KeyValueExpr{
+			Key:   &ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", p.Name)},
+			Value: ast.NewIdent(p.Name),
+		})
+	}
+	capture := &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   ast.NewIdent("lx"),
+			Sel: ast.NewIdent("SpyCapture"),
+		},
+		Args: []ast.Expr{
+			&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", funcName)},
+			&ast.CompositeLit{
+				Type: &ast.MapType{Key: ast.NewIdent("string"), Value: &ast.InterfaceType{Methods: &ast.FieldList{}}},
+				Elts: elts,
+			},
+		},
+	}
+	return &ast.DeferStmt{
+		Call: &ast.CallExpr{
+			Fun: &ast.FuncLit{
+				Type: &ast.FuncType{Params: &ast.FieldList{}},
+				Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{X: capture}}},
+			},
+		},
+	}
+}
+
+func newSpyCall(funcName string, typ ast.Expr, val ast.Expr) *ast.CallExpr {
+	if ident, ok := typ.(*ast.Ident); ok && ident.Name == "error" {
+		return &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   ast.NewIdent("lx"),
+				Sel: ast.NewIdent("SpyError"),
+			},
+			Args: []ast.Expr{
+				&ast.BasicLit{
+					Kind:  token.STRING,
+					Value: fmt.Sprintf("%q", funcName),
+				},
+				val,
+			},
+		}
+	}
+
+	return &ast.CallExpr{
+		Fun: &ast.IndexExpr{
+			X: &ast.SelectorExpr{
+				X:   ast.NewIdent("lx"),
+				Sel: ast.NewIdent("Spy"),
+			},
+			Index: typ,
+		},
+		Args: []ast.Expr{
+			&ast.BasicLit{
+				Kind:  token.STRING,
+				Value: fmt.Sprintf("%q", funcName),
+			},
+			val,
+		},
+	}
+}
+
+// genCtxParam returns the parameter of fn passed as the context to its lx.GenCtx call, or ""
+// when fn has no such call or its context is not a parameter.
+func genCtxParam(fn *ast.FuncDecl) string {
+	params := make(map[string]bool)
+	for _, field := range fn.Type.Params.List {
+		for _, name := range field.Names {
+			params[name.Name] = true
+		}
+	}
+
+	name := ""
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && isLxCall(call, "GenCtx") && len(call.Args) > 0 {
+			if id, ok := call.Args[0].(*ast.Ident); ok && params[id.Name] {
+				name = id.Name
+			}
+		}
+		return name == ""
+	})
+	return name
+}
+
+// withSpyCtx turns an lx.Spy[T]("F", v) call into lx.SpyCtx[T](ctx, "F", v), so values
+// returned after ctx is done are not recorded. Other calls, such as lx.SpyError, are kept.
+func withSpyCtx(call *ast.CallExpr, ctx string) *ast.CallExpr {
+	idx, ok := call.Fun.(*ast.IndexExpr)
+	if ctx == "" || !ok {
+		return call
+	}
+	return &ast.CallExpr{
+		Fun: &ast.IndexExpr{
+			X:     &ast.SelectorExpr{X: ast.NewIdent("lx"), Sel: ast.NewIdent("SpyCtx")},
+			Index: idx.Index,
+		},
+		Args: append([]ast.Expr{ast.NewIdent(ctx)}, call.Args...),
+	}
+}
+
+func hasBareReturn(body *ast.BlockStmt) bool {
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			if len(n.Results) == 0 {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+func genCallLines(fset *token.FileSet, node *ast.File) []int {
+	var lines []int
+	ast.Inspect(node, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && isLxGenCall(call) {
+			lines = append(lines, fset.Position(call.Pos()).Line)
+		}
+		return true
+	})
+	return lines
+}
+
+func remapTraceLines(traces []TraceData, backups map[string]fileBackup) {
+	byAbs := make(map[string]map[int]int, len(backups))
+	for path, b := range backups {
+		if abs, err := filepath.Abs(path); err == nil && b.GenLines != nil {
+			byAbs[abs] = b.GenLines
+		}
+	}
+
+	for i := range traces {
+		if traces[i].Kind != "INPUT" {
+			continue
+		}
+		if lines, ok := byAbs[traces[i].File]; ok {
+			if orig, ok := lines[traces[i].Line]; ok {
+				traces[i].Line = orig
+			}
+		}
+	}
 }
 
 func revertCode(backups map[string]fileBackup) {
 	for path, b := range backups {
-		if err := os.WriteFile(path, b.Data, b.Mode); err != nil {
-			fmt.Printf("[lx] [Error] Recovery failed (%s): %v\n", path, err)
+		if err := writeFileAtomic(path, b.Data, b.Mode); err != nil {
+			logger.Error("recovery failed", "file", path, "err", err)
+		}
+	}
+}
+
+// defaultExcludeDirs are the directory names skipped when the config sets no exclude_dirs.
+var defaultExcludeDirs = []string{"vendor", ".git", "testdata"}
+
+// lxIgnoreFile lists directory name globs, one per line, to skip below the directory that
+// holds it, like a .gitignore.
+const lxIgnoreFile = ".lxignore"
+
+// pathFilter holds the -exclude-files and -exclude-dirs glob patterns, matched against base
+// names, and the build context whose //go:build constraints a file must satisfy. The zero
+// value skips defaultExcludeDirs.
+type pathFilter struct {
+	files []string
+	dirs  []string
+	build *build.Context
+}
+
+// newPathFilter builds the filter for -exclude-files and -exclude-dirs. The directory globs
+// are added to configDirs, the exclude_dirs of the config, or to defaultExcludeDirs when the
+// config sets none.
+func newPathFilter(files, dirs string, configDirs []string, tags string) (pathFilter, error) {
+	ctxt := build.Default
+	ctxt.BuildTags = splitBuildTags(tags)
+	if configDirs == nil {
+		configDirs = defaultExcludeDirs
+	}
+	f := pathFilter{
+		files: splitPatterns(files),
+		dirs:  append(append([]string{}, configDirs...), splitPatterns(dirs)...),
+		build: &ctxt,
+	}
+	for _, patterns := range [][]string{f.files, f.dirs} {
+		for _, p := range patterns {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return f, fmt.Errorf("bad exclude pattern %q: %w", p, err)
+			}
+		}
+	}
+	return f, nil
+}
+
+func splitPatterns(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// skipFile reports whether path is excluded by -exclude-files or is left out of the build
+// for the current GOOS, GOARCH and -tags, in which case the capture run never executes it.
+func (f pathFilter) skipFile(path string) bool {
+	if matchAnyGlob(f.files, filepath.Base(path)) {
+		return true
+	}
+	if f.build == nil {
+		return false
+	}
+	if ok, err := f.build.MatchFile(filepath.Dir(path), filepath.Base(path)); err == nil && !ok {
+		logger.Debug("skipping file excluded by build constraints", "file", path)
+		return true
+	}
+	return false
+}
+
+func splitBuildTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// skipDir reports whether the directory at path, below the walk root, is excluded by
+// -exclude-dirs, exclude_dirs or a .lxignore file in root or any directory between them.
+func (f pathFilter) skipDir(root, path string) bool {
+	dirs := f.dirs
+	if dirs == nil {
+		dirs = defaultExcludeDirs
+	}
+	name := filepath.Base(path)
+	if matchAnyGlob(dirs, name) {
+		return true
+	}
+
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if matchAnyGlob(readLxIgnore(dir), name) {
+			return true
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return false
 		}
 	}
 }
 
-func walkGoFiles(root string, fn func(path string, d fs.DirEntry) error) error {
+// readLxIgnore returns the patterns of the .lxignore file in dir, skipping blank lines and
+// # comments. A trailing or leading slash is dropped, as patterns only match directory names.
+func readLxIgnore(dir string) []string {
+	data, err := os.ReadFile(filepath.Join(dir, lxIgnoreFile))
+	if err != nil {
+		return nil
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.Trim(strings.TrimSpace(line), "/")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			logger.Warn("ignoring bad .lxignore pattern", "file", filepath.Join(dir, lxIgnoreFile), "pattern", line)
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func walkGoFiles(root string, filter pathFilter, fn func(path string, d fs.DirEntry) error) error {
+	for _, r := range projectRoots(root) {
+		if err := walkGoFilesIn(r, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkGoFilesIn(root string, filter pathFilter, fn func(path string, d fs.DirEntry) error) error {
 	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
 		if d.IsDir() {
-
-			name := d.Name()
-			if name == "vendor" || name == ".git" {
+			if path != root && filter.skipDir(root, path) {
 				return filepath.SkipDir
 			}
 			return nil
 		}
 
-		if filepath.Ext(path) != ".go" {
-			return nil
-		}
-
-		if strings.Contains(path, string(filepath.Separator)+"vendor"+string(filepath.Separator)) ||
-			strings.Contains(path, string(filepath.Separator)+".git"+string(filepath.Separator)) {
+		if filepath.Ext(path) != ".go" || filter.skipFile(path) {
 			return nil
 		}
 		return fn(path, d)
 	})
 }
 
+// makeStubSafe rewrites a body that holds nothing but lx calls, panics and returns (a stub
+// awaiting generation) so that it cannot panic when run, e.g. from init() during capture
+// (-init-safe). The panics are dropped and, when no return is left, a return of zero values
+// is added. It reports whether the body changed.
+func makeStubSafe(fset *token.FileSet, fn *ast.FuncDecl) bool {
+	var stmts []ast.Stmt
+	hasReturn, changed := false, false
+	for _, stmt := range fn.Body.List {
+		switch st := stmt.(type) {
+		case *ast.ReturnStmt:
+			hasReturn = true
+		case *ast.ExprStmt:
+			call, ok := st.X.(*ast.CallExpr)
+			if !ok {
+				return false
+			}
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "panic" {
+				changed = true
+				continue
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return false
+			}
+			if x, ok := sel.X.(*ast.Ident); !ok || x.Name != "lx" {
+				return false
+			}
+		default:
+			return false
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	if results := fn.Type.Results; !hasReturn && results != nil && len(results.List) > 0 {
+		ret := &ast.ReturnStmt{}
+		if len(results.List[0].Names) == 0 {
+			for _, field := range results.List {
+				ret.Results = append(ret.Results, zeroValueExpr(fset, field.Type))
+			}
+		}
+		stmts = append(stmts, ret)
+		changed = true
+	}
+	if changed {
+		fn.Body.List = stmts
+	}
+	return changed
+}
+
 func hasLxGenCall(body *ast.BlockStmt) bool {
 	if body == nil {
 		return false
 	}
 	found := false
+	litBodies := funcLitBodies(body)
 	ast.Inspect(body, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok && litBodies[lit.Body] {
+			return false
+		}
 		call, ok := n.(*ast.CallExpr)
 		if !ok {
 			return true
@@ -202,6 +693,22 @@ func hasLxGenCall(body *ast.BlockStmt) bool {
 }
 
 func isLxGenCall(call *ast.CallExpr) bool {
+	return isLxCall(call, "Gen") || isLxCall(call, "GenWithExamples") || isLxCall(call, "GenIf") || isLxCall(call, "GenCtx")
+}
+
+func isLxLangCall(call *ast.CallExpr) bool {
+	return isLxCall(call, "Lang")
+}
+
+func isLxMustCompileCall(call *ast.CallExpr) bool {
+	return isLxCall(call, "MustCompile")
+}
+
+func isLxAssertCall(call *ast.CallExpr) bool {
+	return isLxCall(call, "Assert")
+}
+
+func isLxCall(call *ast.CallExpr, name string) bool {
 	sel, ok := call.Fun.(*ast.SelectorExpr)
 	if !ok {
 		return false
@@ -210,7 +717,7 @@ func isLxGenCall(call *ast.CallExpr) bool {
 	if !ok {
 		return false
 	}
-	return x.Name == "lx" && sel.Sel.Name == "Gen"
+	return x.Name == "lx" && sel.Sel.Name == name
 }
 
 func isSpyCall(expr ast.Expr) bool {
@@ -218,10 +725,14 @@ func isSpyCall(expr ast.Expr) bool {
 	if !ok {
 		return false
 	}
-	sel, ok := call.Fun.(*ast.SelectorExpr)
+	fun := call.Fun
+	if idx, ok := fun.(*ast.IndexExpr); ok {
+		fun = idx.X
+	}
+	sel, ok := fun.(*ast.SelectorExpr)
 	if !ok {
 		return false
 	}
 	x, ok := sel.X.(*ast.Ident)
-	return ok && x.Name == "lx" && sel.Sel.Name == "Spy"
+	return ok && x.Name == "lx" && (sel.Sel.Name == "Spy" || sel.Sel.Name == "SpyMulti" || sel.Sel.Name == "SpyCtx" || sel.Sel.Name == "SpyError" || sel.Sel.Name == "SpyJSON")
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// instrumentSource writes src to a temporary main.go, runs injectSpyCode on it and returns
+// the instrumented file.
+func instrumentSource(t *testing.T, src string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := injectSpyCode(dir, pathFilter{}, "", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestInjectSpyCodeBareReturn(t *testing.T) {
+	out := instrumentSource(t, `package main
+
+import "github.com/chebread/lx"
+
+func Split(s string) (head string, _ int, err error) {
+	if s == "" {
+		return "", 0, nil
+	}
+	lx.Gen("split off the first word of s")
+	return
+}
+`)
+
+	want := `	defer func() {
+		lx.Spy[string]("Split", head)
+		lx.SpyError("Split", err)
+	}()
+`
+	if !strings.Contains(out, want) {
+		t.Errorf("missing deferred spy on the named results:\n%s", out)
+	}
+	if strings.Contains(out, `"Split", _)`) {
+		t.Errorf("the _ result was recorded:\n%s", out)
+	}
+	// Explicit returns are left alone: they assign the named results before the deferred
+	// spies run, so those still record the returned values.
+	if !strings.Contains(out, "\t\treturn \"\", 0, nil\n") || strings.Count(out, `lx.Spy[string]("Split"`) != 1 {
+		t.Errorf("explicit return was rewritten:\n%s", out)
+	}
+}
+
+func TestInjectSpyCodeExplicitReturn(t *testing.T) {
+	out := instrumentSource(t, `package main
+
+import "github.com/chebread/lx"
+
+func Double(n int) (r int) {
+	lx.Gen("twice n")
+	return n * 2
+}
+`)
+	if !strings.Contains(out, `return lx.Spy[int]("Double", n*2)`) {
+		t.Errorf("return value not wrapped:\n%s", out)
+	}
+	if strings.Contains(out, "defer") {
+		t.Errorf("unexpected defer without a bare return:\n%s", out)
+	}
+}
+
+func TestInjectSpyCodeVoidMixedParams(t *testing.T) {
+	out := instrumentSource(t, `package main
+
+import (
+	"bytes"
+
+	"github.com/chebread/lx"
+)
+
+func Greet(w *bytes.Buffer, name string, done chan bool, times int) {
+	lx.Gen("write a greeting for name to w, times times")
+}
+`)
+	for _, want := range []string{
+		`lx.SpyCapture("Greet", map[string]interface`,
+		`"w": w})`,
+		`defer lx.SpyVoidArgs("Greet", name, times)`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestScanAndMergeVoidArgsAndCapture(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	src := "package main\n\nimport \"github.com/chebread/lx\"\n\nfunc Greet(w *[]string, name string) {\n\tlx.Gen(\"greet name\")\n}\n"
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	traces := []TraceData{
+		{Kind: "OUTPUT", Function: "Greet", File: path, Value: []byte(`{"w":["hi ann"]}`)},
+		{Kind: "OUTPUT_VOID", Function: "Greet", File: path, Value: []byte(`["ann"]`)},
+	}
+	targets := scanAndMerge(dir, pathFilter{}, traces, false)
+	if len(targets) != 1 {
+		t.Fatalf("targets = %d, want 1", len(targets))
+	}
+	if got := targets[0]; !strings.Contains(got.Output, `"hi ann"`) || !strings.Contains(got.CallArgs, `"ann"`) {
+		t.Errorf("Output = %q, CallArgs = %q; want both recorded", got.Output, got.CallArgs)
+	}
+}
+
+func TestInjectSpyCodeQualifiedResult(t *testing.T) {
+	// The result type is spelled with the file's own import name, so lx.Spy needs no new import.
+	out := instrumentSource(t, `package main
+
+import (
+	stdio "io"
+	"strings"
+
+	"github.com/chebread/lx"
+)
+
+func Open(s string) stdio.Reader {
+	lx.Gen("a reader over s")
+	return strings.NewReader(s)
+}
+`)
+	if !strings.Contains(out, `return lx.Spy[stdio.Reader]("Open", strings.NewReader(s))`) {
+		t.Errorf("result not wrapped with the aliased type:\n%s", out)
+	}
+	if strings.Count(out, `"io"`) != 1 {
+		t.Errorf("import of io added or lost:\n%s", out)
+	}
+}
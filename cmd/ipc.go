@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ipcWriteTimeout bounds a write to one client, so a stalled editor cannot hold up generation.
+const ipcWriteTimeout = time.Second
+
+// ipcEvent is one line of the -ipc-socket event stream; see PROTOCOL.md.
+type ipcEvent struct {
+	Event  string `json:"event"`
+	File   string `json:"file"`
+	Func   string `json:"func"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Ms     int64  `json:"ms"`
+}
+
+// eventServer sends JSON events to every client connected to the -ipc-socket listener.
+type eventServer struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	clients map[net.Conn]struct{}
+}
+
+// activeEvents is the running event server, if any.
+var activeEvents atomic.Pointer[eventServer]
+
+// startEventServer listens on the Unix domain socket at path (AF_UNIX also works on
+// Windows 10 and later) and accepts clients until stop is called. A stale socket left by
+// an earlier run is removed first. An empty path starts nothing.
+func startEventServer(path string) (stop func(), err error) {
+	if path == "" {
+		return func() {}, nil
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &eventServer{ln: ln, clients: make(map[net.Conn]struct{})}
+	activeEvents.Store(s)
+	go s.accept()
+	logger.Info("Streaming events", "socket", path)
+
+	return func() {
+		activeEvents.CompareAndSwap(s, nil)
+		ln.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for c := range s.clients {
+			c.Close()
+		}
+	}, nil
+}
+
+func (s *eventServer) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("ipc socket accept failed", "err", err)
+			}
+			return
+		}
+		s.mu.Lock()
+		s.clients[conn] = struct{}{}
+		s.mu.Unlock()
+	}
+}
+
+// broadcast writes e as a JSON line to every client, dropping those that fail.
+func (s *eventServer) broadcast(e ipcEvent) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.SetWriteDeadline(time.Now().Add(ipcWriteTimeout))
+		if _, err := c.Write(line); err != nil {
+			c.Close()
+			delete(s.clients, c)
+		}
+	}
+}
+
+// emitResultEvent sends a "complete" event for r when an event server is running.
+func emitResultEvent(r GenerationResult) {
+	s := activeEvents.Load()
+	if s == nil {
+		return
+	}
+	status := "ok"
+	switch {
+	case r.failed():
+		status = "error"
+	case r.Status == "skipped":
+		status = "skipped"
+	}
+	s.broadcast(ipcEvent{
+		Event:  "complete",
+		File:   r.FilePath,
+		Func:   r.FuncName,
+		Status: status,
+		Error:  r.Error,
+		Ms:     r.DurationMs,
+	})
+}
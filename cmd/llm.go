@@ -3,18 +3,133 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
 	"os/exec"
+	"slices"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 
+	"golang.org/x/time/rate"
 	"google.golang.org/genai"
 )
 
 type LLM interface {
 	Generate(ctx context.Context, model string, prompt string) (string, error)
+
+	// GenerateWithRoles sends system as the system message and user as the user message.
+	// Providers without a system role prepend system to user. An empty system is the same
+	// as Generate(ctx, model, user).
+	GenerateWithRoles(ctx context.Context, model, system, user string) (string, error)
+
+	// GenerateWithUsage is GenerateWithRoles that also returns the tokens the call used.
+	// The usage is zero when no provider was called, e.g. for a cached response, and has
+	// Unreported set when the provider does not report it.
+	GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error)
+}
+
+// joinRoles folds a system message into the prompt for providers without a system role.
+func joinRoles(system, user string) string {
+	if system == "" {
+		return user
+	}
+	return system + "\n\n" + user
+}
+
+// chatMessages builds the messages of a chat completion request.
+func chatMessages(system, user string) []chatMessage {
+	if system == "" {
+		return []chatMessage{{Role: "user", Content: user}}
+	}
+	return []chatMessage{{Role: "system", Content: system}, {Role: "user", Content: user}}
+}
+
+type TokenUsage struct {
+	InputTokens, OutputTokens int
+	// Unreported counts the calls whose provider did not report their usage.
+	Unreported int
+}
+
+func (u TokenUsage) add(v TokenUsage) TokenUsage {
+	return TokenUsage{
+		InputTokens:  u.InputTokens + v.InputTokens,
+		OutputTokens: u.OutputTokens + v.OutputTokens,
+		Unreported:   u.Unreported + v.Unreported,
+	}
+}
+
+// reportedUsage is the usage of a response that reports input and output tokens. Both at
+// zero means the response left the usage out.
+func reportedUsage(input, output int) TokenUsage {
+	if input == 0 && output == 0 {
+		return TokenUsage{Unreported: 1}
+	}
+	return TokenUsage{InputTokens: input, OutputTokens: output}
+}
+
+// usageCounter is the outermost LLM of a run. It keeps the running total of the usage
+// returned by the calls made through it, for printTokenUsage.
+type usageCounter struct {
+	llm LLM
+
+	mu    sync.Mutex
+	total TokenUsage
+}
+
+func (u *usageCounter) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return u.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (u *usageCounter) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := u.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (u *usageCounter) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	text, usage, err := u.llm.GenerateWithUsage(ctx, model, system, user)
+	u.mu.Lock()
+	u.total = u.total.add(usage)
+	u.mu.Unlock()
+	return text, usage, err
+}
+
+func (u *usageCounter) usage() TokenUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.total
+}
+
+// Gemini Flash list prices, used when the config sets no cost rates.
+const (
+	defaultCostPer1kInput  = 0.0001
+	defaultCostPer1kOutput = 0.0004
+)
+
+func estimateCost(u TokenUsage, cfg *Config) float64 {
+	in, out := defaultCostPer1kInput, defaultCostPer1kOutput
+	if cfg.CostPer1kInput != nil {
+		in = *cfg.CostPer1kInput
+	}
+	if cfg.CostPer1kOutput != nil {
+		out = *cfg.CostPer1kOutput
+	}
+	return float64(u.InputTokens)/1000*in + float64(u.OutputTokens)/1000*out
+}
+
+func printTokenUsage(cfg *Config, u TokenUsage) {
+	if u.Unreported > 0 {
+		logger.Warn("The provider reported no token usage for some calls; the totals below leave them out", "provider", cfg.Provider, "calls", u.Unreported)
+	}
+	if u.InputTokens == 0 && u.OutputTokens == 0 {
+		return
+	}
+	logger.Info("Total tokens", "input", u.InputTokens, "output", u.OutputTokens, "estimated_cost", fmt.Sprintf("$%.4f", estimateCost(u, cfg)))
 }
 
 type commandLLM struct {
@@ -24,9 +139,61 @@ type commandLLM struct {
 
 type geminiLLM struct {
 	client *genai.Client
+	sampling
 }
 
+type sampling struct {
+	temperature *float32
+	topP        *float32
+}
+
+type openaiLLM struct {
+	apiKey  string
+	baseURL string
+	client  *http.Client
+	sampling
+}
+
+type claudeLLM struct {
+	apiKey  string
+	baseURL string
+	client  *http.Client
+	sampling
+}
+
+type azureOpenAILLM struct {
+	apiKey       string
+	resourceName string
+	deploymentID string
+	apiVersion   string
+	client       *http.Client
+	sampling
+}
+
+type ollamaLLM struct {
+	baseURL string
+	client  *http.Client
+	sampling
+}
+
+const (
+	ollamaBaseURL    = "http://localhost:11434"
+	openaiBaseURL    = "https://api.openai.com/v1"
+	anthropicBaseURL = "https://api.anthropic.com/v1"
+	anthropicVersion = "2023-06-01"
+	anthropicMaxTok  = 8192
+	azureAPIVersion  = "2024-06-01"
+)
+
 func newLLM(cfg *Config) (LLM, error) {
+	llm, err := newProviderLLM(cfg)
+	if err != nil || cfg.RequestsPerMinute <= 0 {
+		return llm, err
+	}
+	return newRateLimitedLLM(llm, cfg.RequestsPerMinute), nil
+}
+
+func newProviderLLM(cfg *Config) (LLM, error) {
 	if cfg == nil {
 		return nil, errors.New("nil config")
 	}
@@ -52,7 +219,59 @@ func newLLM(cfg *Config) (LLM, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &geminiLLM{client: client}, nil
+		return &geminiLLM{client: client, sampling: samplingFrom(cfg)}, nil
+
+	case "openai":
+		if strings.TrimSpace(cfg.ApiKey) == "" {
+			return nil, errors.New("empty api_key")
+		}
+		return &openaiLLM{
+			apiKey:   cfg.ApiKey,
+			baseURL:  baseURLOr(cfg.BaseURL, openaiBaseURL),
+			client:   &http.Client{},
+			sampling: samplingFrom(cfg),
+		}, nil
+
+	case "anthropic":
+		if strings.TrimSpace(cfg.ApiKey) == "" {
+			return nil, errors.New("empty api_key")
+		}
+		return &claudeLLM{
+			apiKey:   cfg.ApiKey,
+			baseURL:  baseURLOr(cfg.BaseURL, anthropicBaseURL),
+			client:   &http.Client{},
+			sampling: samplingFrom(cfg),
+		}, nil
+
+	case "azure-openai":
+		if strings.TrimSpace(cfg.ApiKey) == "" {
+			return nil, errors.New("empty api_key")
+		}
+		if strings.TrimSpace(cfg.ResourceName) == "" {
+			return nil, errors.New("empty resource_name (required for azure-openai provider)")
+		}
+		if strings.TrimSpace(cfg.DeploymentID) == "" {
+			return nil, errors.New("empty deployment_id (required for azure-openai provider)")
+		}
+		apiVersion := strings.TrimSpace(cfg.APIVersion)
+		if apiVersion == "" {
+			apiVersion = azureAPIVersion
+		}
+		return &azureOpenAILLM{
+			apiKey:       cfg.ApiKey,
+			resourceName: strings.TrimSpace(cfg.ResourceName),
+			deploymentID: strings.TrimSpace(cfg.DeploymentID),
+			apiVersion:   apiVersion,
+			client:       &http.Client{},
+			sampling:     samplingFrom(cfg),
+		}, nil
+
+	case "ollama":
+		return &ollamaLLM{
+			baseURL:  baseURLOr(cfg.BaseURL, ollamaBaseURL),
+			client:   &http.Client{},
+			sampling: samplingFrom(cfg),
+		}, nil
 
 	case "command":
 		if strings.TrimSpace(cfg.BinPath) == "" {
@@ -70,21 +289,330 @@ func newLLM(cfg *Config) (LLM, error) {
 }
 
 func (g *geminiLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
-	resp, err := g.client.Models.GenerateContent(ctx, model, genai.Text(prompt), nil)
+	return g.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (g *geminiLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := g.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (g *geminiLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	var genCfg *genai.GenerateContentConfig
+	if sp := g.forCall(ctx); sp.temperature != nil || sp.topP != nil {
+		genCfg = &genai.GenerateContentConfig{Temperature: sp.temperature, TopP: sp.topP}
+	}
+	if system != "" {
+		if genCfg == nil {
+			genCfg = &genai.GenerateContentConfig{}
+		}
+		genCfg.SystemInstruction = genai.NewContentFromText(system, genai.RoleUser)
+	}
+	resp, err := g.client.Models.GenerateContent(ctx, model, genai.Text(user), genCfg)
+	if err != nil {
+		return "", TokenUsage{}, err
+	}
+	usage := TokenUsage{Unreported: 1}
+	if md := resp.UsageMetadata; md != nil {
+		usage = TokenUsage{InputTokens: int(md.PromptTokenCount), OutputTokens: int(md.CandidatesTokenCount)}
+	}
+	return resp.Text(), usage, nil
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model       string        `json:"model"`
+	Messages    []chatMessage `json:"messages"`
+	Temperature *float32      `json:"temperature,omitempty"`
+	TopP        *float32      `json:"top_p,omitempty"`
+}
+
+type chatCompletionResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func (o *openaiLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return o.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (o *openaiLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := o.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (o *openaiLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	reqBody := chatCompletionRequest{
+		Model:       model,
+		Messages:    chatMessages(system, user),
+		Temperature: o.forCall(ctx).temperature,
+		TopP:        o.topP,
+	}
+	headers := map[string]string{
+		"Authorization": "Bearer " + o.apiKey,
+	}
+
+	var resp chatCompletionResponse
+	if err := postJSON(ctx, o.client, "openai", strings.TrimRight(o.baseURL, "/")+"/chat/completions", headers, reqBody, &resp); err != nil {
+		return "", TokenUsage{}, err
+	}
+	usage := reportedUsage(resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	if len(resp.Choices) == 0 {
+		return "", usage, errors.New("openai: response has no choices")
+	}
+	return resp.Choices[0].Message.Content, usage, nil
+}
+
+func (a *azureOpenAILLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return a.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (a *azureOpenAILLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := a.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (a *azureOpenAILLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	endpoint := fmt.Sprintf("https://%s.openai.azure.com/openai/deployments/%s/chat/completions?api-version=%s",
+		a.resourceName,
+		url.PathEscape(a.deploymentID),
+		url.QueryEscape(a.apiVersion),
+	)
+	reqBody := chatCompletionRequest{
+		Model:       model,
+		Messages:    chatMessages(system, user),
+		Temperature: a.forCall(ctx).temperature,
+		TopP:        a.topP,
+	}
+	headers := map[string]string{
+		"api-key": a.apiKey,
+	}
+
+	var resp chatCompletionResponse
+	if err := postJSON(ctx, a.client, "azure-openai", endpoint, headers, reqBody, &resp); err != nil {
+		return "", TokenUsage{}, err
+	}
+	usage := reportedUsage(resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	if len(resp.Choices) == 0 {
+		return "", usage, errors.New("azure-openai: response has no choices")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), usage, nil
+}
+
+type messagesRequest struct {
+	Model       string        `json:"model"`
+	MaxTokens   int           `json:"max_tokens"`
+	System      string        `json:"system,omitempty"`
+	Messages    []chatMessage `json:"messages"`
+	Temperature *float32      `json:"temperature,omitempty"`
+	TopP        *float32      `json:"top_p,omitempty"`
+}
+
+type messagesResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+func (c *claudeLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return c.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (c *claudeLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := c.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (c *claudeLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	reqBody := messagesRequest{
+		Model:       model,
+		MaxTokens:   anthropicMaxTok,
+		System:      system,
+		Messages:    []chatMessage{{Role: "user", Content: user}},
+		Temperature: c.forCall(ctx).temperature,
+		TopP:        c.topP,
+	}
+	headers := map[string]string{
+		"x-api-key":         c.apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+
+	var resp messagesResponse
+	if err := postJSON(ctx, c.client, "anthropic", strings.TrimRight(c.baseURL, "/")+"/messages", headers, reqBody, &resp); err != nil {
+		return "", TokenUsage{}, err
+	}
+	usage := reportedUsage(resp.Usage.InputTokens, resp.Usage.OutputTokens)
+	if len(resp.Content) == 0 {
+		return "", usage, errors.New("anthropic: response has no content")
+	}
+	return resp.Content[0].Text, usage, nil
+}
+
+type ollamaGenerateRequest struct {
+	Model   string         `json:"model"`
+	System  string         `json:"system,omitempty"`
+	Prompt  string         `json:"prompt"`
+	Stream  bool           `json:"stream"`
+	Options map[string]any `json:"options,omitempty"`
+}
+
+type ollamaGenerateResponse struct {
+	Response        string `json:"response"`
+	Error           string `json:"error"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+}
+
+func (o *ollamaLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return o.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (o *ollamaLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := o.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (o *ollamaLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	reqBody := ollamaGenerateRequest{
+		Model:  model,
+		System: system,
+		Prompt: user,
+		Stream: false,
+	}
+	if sp := o.forCall(ctx); sp.temperature != nil || sp.topP != nil {
+		reqBody.Options = map[string]any{}
+		if sp.temperature != nil {
+			reqBody.Options["temperature"] = *sp.temperature
+		}
+		if sp.topP != nil {
+			reqBody.Options["top_p"] = *sp.topP
+		}
+	}
+
+	var resp ollamaGenerateResponse
+	if err := postJSON(ctx, o.client, "ollama", strings.TrimRight(o.baseURL, "/")+"/api/generate", nil, reqBody, &resp); err != nil {
+		return "", TokenUsage{}, err
+	}
+	if resp.Error != "" {
+		return "", TokenUsage{}, fmt.Errorf("ollama API error: %s", resp.Error)
+	}
+	return resp.Response, reportedUsage(resp.PromptEvalCount, resp.EvalCount), nil
+}
+
+type temperatureJitterKey struct{}
+
+// withTemperatureJitter shifts the sampling temperature of LLM calls made with ctx by delta.
+func withTemperatureJitter(ctx context.Context, delta float32) context.Context {
+	return context.WithValue(ctx, temperatureJitterKey{}, delta)
+}
+
+func temperatureJitter(ctx context.Context) (float32, bool) {
+	delta, ok := ctx.Value(temperatureJitterKey{}).(float32)
+	return delta, ok
+}
+
+func (s sampling) forCall(ctx context.Context) sampling {
+	delta, ok := temperatureJitter(ctx)
+	if !ok {
+		return s
+	}
+	base := float32(0.7)
+	if s.temperature != nil {
+		base = *s.temperature
+	}
+	t := min(max(base+delta, 0), 1)
+	s.temperature = &t
+	return s
+}
+
+func samplingFrom(cfg *Config) sampling {
+	return sampling{temperature: cfg.Temperature, topP: cfg.TopP}
+}
+
+func baseURLOr(configured, def string) string {
+	if u := strings.TrimSpace(configured); u != "" {
+		return u
+	}
+	return def
+}
+
+func postJSON(ctx context.Context, client *http.Client, provider, endpoint string, headers map[string]string, reqBody, respBody any) error {
+	payload, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timeout reached (%s): %s request aborted", ctx.Err(), provider)
+		}
+		return fmt.Errorf("%s connection failed: %w", provider, err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, 8*1024*1024))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s API error (status %d): %s", provider, res.StatusCode, strings.TrimSpace(string(data)))
 	}
-	return resp.Text(), nil
+
+	if err := json.Unmarshal(data, respBody); err != nil {
+		return fmt.Errorf("%s response decode failed: %w", provider, err)
+	}
+	return nil
 }
 
 func (c *commandLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return c.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+// GenerateWithRoles substitutes {{system}} in args with the system message. Without that
+// placeholder, the system message is prepended to {{prompt}}.
+func (c *commandLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := c.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (c *commandLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
 	var finalArgs []string
 
 	if len(c.args) == 0 {
-		finalArgs = []string{"-p", prompt, "-m", model, "-o", "text"}
+		finalArgs = []string{"-p", joinRoles(system, user), "-m", model, "-o", "text"}
 	} else {
+		prompt := user
+		if !slices.ContainsFunc(c.args, func(arg string) bool { return strings.Contains(arg, "{{system}}") }) {
+			prompt = joinRoles(system, user)
+		}
 		for _, arg := range c.args {
 			replaced := strings.ReplaceAll(arg, "{{prompt}}", prompt)
+			replaced = strings.ReplaceAll(replaced, "{{system}}", system)
 			replaced = strings.ReplaceAll(replaced, "{{model}}", model)
 			finalArgs = append(finalArgs, replaced)
 		}
@@ -92,11 +620,7 @@ func (c *commandLLM) Generate(ctx context.Context, model string, prompt string)
 
 	cmd := exec.CommandContext(ctx, c.binPath, finalArgs...)
 
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	cmd.Cancel = func() error {
-		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
-	}
+	setProcessGroupKill(cmd)
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
@@ -105,21 +629,288 @@ func (c *commandLLM) Generate(ctx context.Context, model string, prompt string)
 
 	if err := cmd.Run(); err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			return "", fmt.Errorf("timeout reached (%s): process group killed", ctx.Err())
+			return "", TokenUsage{}, fmt.Errorf("timeout reached (%s): process group killed", ctx.Err())
 		}
-		return "", fmt.Errorf("command execution failed: %v\nStderr: %s", err, stderr.String())
+		return "", TokenUsage{}, fmt.Errorf("command execution failed: %v\nStderr: %s", err, stderr.String())
 	}
 
-	return out.String(), nil
+	// A command reports no token usage.
+	return out.String(), TokenUsage{Unreported: 1}, nil
 }
 
-func diagnoseLLMError(err error) string {
+type rateLimitedLLM struct {
+	llm     LLM
+	limiter *rate.Limiter
+}
+
+func newRateLimitedLLM(llm LLM, perMinute int) *rateLimitedLLM {
+	return &rateLimitedLLM{llm: llm, limiter: rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), 1)}
+}
+
+func (r *rateLimitedLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return r.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (r *rateLimitedLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := r.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (r *rateLimitedLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return "", TokenUsage{}, fmt.Errorf("timeout reached (%w): request not sent within the rate limit", err)
+	}
+	return r.llm.GenerateWithUsage(ctx, model, system, user)
+}
+
+var errCostLimit = fmt.Errorf("%w: -cost-limit reached", errSkipped)
+
+// costLimitedLLM refuses every call once the estimated input cost of the run would exceed
+// limit dollars. Input tokens are estimated as len(prompt)/4, priced at cost_per_1k_input.
+type costLimitedLLM struct {
+	llm   LLM
+	cfg   *Config
+	limit float64
+
+	mu      sync.Mutex
+	spent   float64
+	reached bool
+}
+
+func (c *costLimitedLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return c.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (c *costLimitedLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := c.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (c *costLimitedLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	cost := estimateCost(TokenUsage{InputTokens: (len(system) + len(user)) / 4}, c.cfg)
+
+	c.mu.Lock()
+	if c.reached || c.spent+cost > c.limit {
+		if !c.reached {
+			logger.Warn("Cost limit reached; skipping the remaining generations", "limit", fmt.Sprintf("$%g", c.limit), "spent", fmt.Sprintf("$%.4f", c.spent))
+		}
+		c.reached = true
+		c.mu.Unlock()
+		return "", TokenUsage{}, errCostLimit
+	}
+	c.spent += cost
+	c.mu.Unlock()
+
+	return c.llm.GenerateWithUsage(ctx, model, system, user)
+}
+
+var errSimulated = fmt.Errorf("%w: -simulate -dry-run printed the prompt", errSkipped)
+
+// promptPrinterLLM stands in for the provider under -simulate -dry-run. It prints each
+// prompt and calls nothing.
+type promptPrinterLLM struct{}
+
+func (p promptPrinterLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return p.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (p promptPrinterLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := p.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+func (promptPrinterLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	diffMu.Lock()
+	defer diffMu.Unlock()
+	if system != "" {
+		fmt.Printf("----- system -----\n%s\n\n", system)
+	}
+	fmt.Printf("----- prompt -----\n%s\n\n", user)
+	return "", TokenUsage{}, errSimulated
+}
+
+type retryingLLM struct {
+	llm         LLM
+	maxAttempts int
+}
+
+func (r *retryingLLM) Generate(ctx context.Context, model string, prompt string) (string, error) {
+	return r.GenerateWithRoles(ctx, model, "", prompt)
+}
+
+func (r *retryingLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	text, _, err := r.GenerateWithUsage(ctx, model, system, user)
+	return text, err
+}
+
+// GenerateWithUsage returns the usage summed over every attempt.
+func (r *retryingLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	var total TokenUsage
+	text, err := withRetry(ctx, r.maxAttempts, func() (string, error) {
+		text, usage, err := r.llm.GenerateWithUsage(ctx, model, system, user)
+		total = total.add(usage)
+		return text, err
+	})
+	return text, total, err
+}
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+func withRetry(ctx context.Context, maxAttempts int, call func() (string, error)) (string, error) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := call()
+		if err == nil || attempt >= maxAttempts || !isRetryable(err) {
+			return resp, err
+		}
+
+		wait := time.Duration(float64(delay) * (0.75 + 0.5*rand.Float64()))
+		logger.Warn("LLM call failed, retrying", "attempt", fmt.Sprintf("%d/%d", attempt, maxAttempts), "wait", wait.Round(time.Millisecond), "err", singleLine(redact(err.Error(), redactSecret)))
+
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(wait):
+		}
+
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+func isRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 429 || apiErr.Code >= 500
+	}
+
 	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "timeout reached"):
+		return false
+	case strings.Contains(msg, "(status 429)"), strings.Contains(msg, "(status 5"):
+		return true
+	case strings.Contains(msg, "quota"), strings.Contains(msg, "RESOURCE_EXHAUSTED"):
+		return true
+	case strings.Contains(msg, "overloaded"), strings.Contains(msg, "UNAVAILABLE"):
+		return true
+	case strings.Contains(msg, "connection"):
+		return true
+	default:
+		return false
+	}
+}
+
+type batchedLLM struct {
+	llm LLM
+}
+
+// batchSpec is one function of a batch prompt. ID is its 1-based position in the batch,
+// which the response echoes, so two targets with the same name stay apart.
+type batchSpec struct {
+	ID   int
+	Func string
+	File string
+	Spec string
+}
+
+type batchItem struct {
+	ID   int    `json:"id"`
+	Func string `json:"func"`
+	Body string `json:"body"`
+}
+
+func (b *batchedLLM) GenerateBatch(ctx context.Context, model string, rules string, specs []batchSpec) ([]batchItem, error) {
+	var sb strings.Builder
+	sb.WriteString("GO FUNC BODY GEN (BATCH).\n\n")
+	sb.WriteString(`Generate a body for EACH function below. Return ONLY a JSON array: [{"id": 1, "func": "Name", "body": "..."}]. One element per function, in the same order, with the id from its FUNCTION heading.`)
+	sb.WriteString("\nThe RULES apply to every body.\n\n")
+	sb.WriteString(rules)
+	for _, spec := range specs {
+		fmt.Fprintf(&sb, "\n\n### FUNCTION %d: %s (%s)\n\n%s", spec.ID, spec.Func, spec.File, spec.Spec)
+	}
+
+	raw, err := b.llm.Generate(ctx, model, sb.String())
+	if err != nil {
+		return nil, err
+	}
+	return parseBatchResponse(raw)
+}
+
+func parseBatchResponse(raw string) ([]batchItem, error) {
+	start := strings.Index(raw, "[")
+	end := strings.LastIndex(raw, "]")
+	if start == -1 || end < start {
+		return nil, errors.New("batch response is not a JSON array")
+	}
+
+	var items []batchItem
+	if err := json.Unmarshal([]byte(raw[start:end+1]), &items); err != nil {
+		return nil, fmt.Errorf("batch response decode failed: %w", err)
+	}
+	return items, nil
+}
+
+// matchBatchItems returns the body answered for each spec, keyed by the spec's index. Items
+// are matched by id; one without a known id falls back to its function name, but only when
+// a single spec has that name. Specs without a body are missing from the map.
+func matchBatchItems(specs []batchSpec, items []batchItem) map[int]string {
+	byID := make(map[int]int, len(specs))
+	byName := make(map[string][]int, len(specs))
+	for i, spec := range specs {
+		byID[spec.ID] = i
+		byName[spec.Func] = append(byName[spec.Func], i)
+	}
+
+	bodies := make(map[int]string, len(specs))
+	for _, item := range items {
+		i, ok := byID[item.ID]
+		if !ok {
+			if same := byName[item.Func]; len(same) == 1 {
+				i, ok = same[0], true
+			}
+		}
+		if _, dup := bodies[i]; ok && !dup {
+			bodies[i] = item.Body
+		}
+	}
+	return bodies
+}
+
+func diagnoseLLMError(err error) string {
+	msg := redact(err.Error(), redactSecret)
 
 	switch {
 	case strings.Contains(msg, "timeout reached"):
 		return fmt.Sprintf("TIMEOUT: The operation exceeded the time limit. (%s)", msg)
 
+	case strings.Contains(msg, "ollama connection failed"):
+		return "Ollama unreachable. Make sure `ollama serve` is running and base_url in 'lx-config.yaml' is correct."
+	case strings.Contains(msg, "ollama API error") && (strings.Contains(msg, "not found") || strings.Contains(msg, "pull")):
+		return "Ollama model not pulled. Run `ollama pull <model>` first."
+
+	case strings.Contains(msg, "overloaded_error"):
+		return "Anthropic is temporarily overloaded. Please try again later."
+	case strings.Contains(msg, "authentication_error"):
+		return "Anthropic rejected the API key. Please double-check the api_key in 'lx-config.yaml'."
+
+	case strings.Contains(msg, "(status 429)"):
+		return "Rate limit reached (HTTP 429). Please wait a moment or lower the request rate."
+	case strings.Contains(msg, "(status 401)"):
+		return "The API key was rejected (HTTP 401). Please double-check the api_key in 'lx-config.yaml'."
+	case strings.Contains(msg, "(status 503)"):
+		return "The provider is overloaded (HTTP 503). Please try again later."
+
 	case strings.Contains(msg, "API_KEY_INVALID"):
 		return "The API key is incorrect. Please double-check the api_key in 'lx-config.yaml'."
 	case strings.Contains(msg, "quota"):
@@ -132,6 +923,6 @@ func diagnoseLLMError(err error) string {
 		return "The network connection is unstable. Please check your Internet connection."
 
 	default:
-		return fmt.Sprintf("An unknown error has occurred: %v", err)
+		return fmt.Sprintf("An unknown error has occurred: %s", msg)
 	}
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenAIGenerate(t *testing.T) {
+	var got chatCompletionRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/chat/completions" {
+			t.Errorf("request = %s %s, want POST /chat/completions", r.Method, r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer sk-test" {
+			t.Errorf("Authorization = %q, want %q", auth, "Bearer sk-test")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"return 42"}}],"usage":{"prompt_tokens":3,"completion_tokens":2}}`))
+	}))
+	defer srv.Close()
+
+	llm, err := newProviderLLM(&Config{Provider: "openai", ApiKey: "sk-test", Model: "gpt-test", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := llm.GenerateWithRoles(context.Background(), "gpt-test", "be brief", "write it")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "return 42" {
+		t.Errorf("text = %q, want the choices[0].message.content %q", out, "return 42")
+	}
+
+	if got.Model != "gpt-test" {
+		t.Errorf("model = %q, want %q", got.Model, "gpt-test")
+	}
+	want := []chatMessage{{Role: "system", Content: "be brief"}, {Role: "user", Content: "write it"}}
+	if len(got.Messages) != len(want) {
+		t.Fatalf("messages = %+v, want %+v", got.Messages, want)
+	}
+	for i := range want {
+		if got.Messages[i] != want[i] {
+			t.Errorf("messages[%d] = %+v, want %+v", i, got.Messages[i], want[i])
+		}
+	}
+}
+
+func TestOpenAIErrorDiagnosis(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusUnauthorized, "The API key was rejected (HTTP 401)"},
+		{http.StatusTooManyRequests, "Rate limit reached (HTTP 429)"},
+		{http.StatusServiceUnavailable, "The provider is overloaded (HTTP 503)"},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error":{"message":"nope"}}`, tt.status)
+		}))
+
+		llm, err := newProviderLLM(&Config{Provider: "openai", ApiKey: "sk-test", Model: "gpt-test", BaseURL: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = llm.Generate(context.Background(), "gpt-test", "write it")
+		srv.Close()
+		if err == nil {
+			t.Fatalf("status %d: expected an error", tt.status)
+		}
+		if msg := diagnoseLLMError(err); !strings.Contains(msg, tt.want) {
+			t.Errorf("status %d: diagnoseLLMError = %q, want it to contain %q", tt.status, msg, tt.want)
+		}
+	}
+}
+
+func TestClaudeGenerate(t *testing.T) {
+	var got messagesRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/messages" {
+			t.Errorf("request = %s %s, want POST /messages", r.Method, r.URL.Path)
+		}
+		if key := r.Header.Get("x-api-key"); key != "sk-ant-test" {
+			t.Errorf("x-api-key = %q, want %q", key, "sk-ant-test")
+		}
+		if v := r.Header.Get("anthropic-version"); v != anthropicVersion {
+			t.Errorf("anthropic-version = %q, want %q", v, anthropicVersion)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[{"type":"text","text":"return 7"}],"usage":{"input_tokens":3,"output_tokens":2}}`))
+	}))
+	defer srv.Close()
+
+	llm, err := newProviderLLM(&Config{Provider: "anthropic", ApiKey: "sk-ant-test", Model: "claude-test", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := llm.GenerateWithRoles(context.Background(), "claude-test", "be brief", "write it")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "return 7" {
+		t.Errorf("text = %q, want the content[0].text %q", out, "return 7")
+	}
+
+	if got.Model != "claude-test" || got.MaxTokens != anthropicMaxTok {
+		t.Errorf("model, max_tokens = %q, %d, want %q, %d", got.Model, got.MaxTokens, "claude-test", anthropicMaxTok)
+	}
+	if got.System != "be brief" {
+		t.Errorf("system = %q, want %q", got.System, "be brief")
+	}
+	want := []chatMessage{{Role: "user", Content: "write it"}}
+	if len(got.Messages) != 1 || got.Messages[0] != want[0] {
+		t.Errorf("messages = %+v, want %+v", got.Messages, want)
+	}
+}
+
+func TestClaudeEmptyContent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"content":[]}`))
+	}))
+	defer srv.Close()
+
+	llm, err := newProviderLLM(&Config{Provider: "anthropic", ApiKey: "k", Model: "m", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := llm.Generate(context.Background(), "m", "p"); err == nil {
+		t.Errorf("err = %v, want a no-content error", err)
+	}
+}
+
+// stubLLM answers every prompt with reply and keeps the last prompt.
+type stubLLM struct {
+	reply  string
+	prompt string
+}
+
+func (s *stubLLM) Generate(ctx context.Context, model, prompt string) (string, error) {
+	s.prompt = prompt
+	return s.reply, nil
+}
+
+func (s *stubLLM) GenerateWithRoles(ctx context.Context, model, system, user string) (string, error) {
+	return s.Generate(ctx, model, system+"\n\n"+user)
+}
+
+func (s *stubLLM) GenerateWithUsage(ctx context.Context, model, system, user string) (string, TokenUsage, error) {
+	text, err := s.GenerateWithRoles(ctx, model, system, user)
+	return text, TokenUsage{}, err
+}
+
+func TestGenerateBatchSameName(t *testing.T) {
+	specs := []batchSpec{
+		{ID: 1, Func: "Parse", File: "a.go", Spec: "parse a"},
+		{ID: 2, Func: "Parse", File: "b.go", Spec: "parse b"},
+		{ID: 3, Func: "Format", File: "b.go", Spec: "format"},
+	}
+	// Answered out of order; the Format item lost its id.
+	llm := &stubLLM{reply: `[{"id": 2, "func": "Parse", "body": "return b"}, {"func": "Format", "body": "return f"}, {"id": 1, "func": "Parse", "body": "return a"}]`}
+
+	items, err := (&batchedLLM{llm: llm}).GenerateBatch(context.Background(), "m", "RULES", specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"### FUNCTION 1: Parse (a.go)", "### FUNCTION 2: Parse (b.go)", `"id": 1`} {
+		if !strings.Contains(llm.prompt, want) {
+			t.Errorf("prompt lacks %q:\n%s", want, llm.prompt)
+		}
+	}
+
+	bodies := matchBatchItems(specs, items)
+	want := map[int]string{0: "return a", 1: "return b", 2: "return f"}
+	for i, body := range want {
+		if bodies[i] != body {
+			t.Errorf("spec %d body = %q, want %q", i+1, bodies[i], body)
+		}
+	}
+}
+
+func TestMatchBatchItemsAmbiguousName(t *testing.T) {
+	specs := []batchSpec{{ID: 1, Func: "Parse"}, {ID: 2, Func: "Parse"}}
+	bodies := matchBatchItems(specs, []batchItem{{Func: "Parse", Body: "return 1"}})
+	if len(bodies) != 0 {
+		t.Errorf("an item without id was matched to one of two same-name functions: %v", bodies)
+	}
+}
+
+func TestUsageCounter(t *testing.T) {
+	cmd := &commandLLM{binPath: "echo", args: []string{"{{prompt}}"}}
+	counter := &usageCounter{llm: newCachedLLM(&countingLLM{}, t.TempDir(), time.Hour)}
+	ctx := context.Background()
+	for range 2 {
+		if _, err := counter.Generate(ctx, "m", "prompt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second call was served from the cache and used nothing.
+	if got, want := counter.usage(), (TokenUsage{InputTokens: 10, OutputTokens: 2}); got != want {
+		t.Errorf("usage = %+v, want %+v", got, want)
+	}
+
+	counter = &usageCounter{llm: cmd}
+	if _, err := counter.Generate(ctx, "m", "prompt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := counter.usage(); got != (TokenUsage{Unreported: 1}) {
+		t.Errorf("command usage = %+v, want one unreported call", got)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logger is the process-wide logger. main replaces it once -log-level and -log-format are parsed.
+var logger = newLogger(slog.LevelInfo, "text", false)
+
+// newLogger builds a logger writing to stdout. omitTime drops the time attribute, for
+// output that is already timestamped (-ci).
+func newLogger(level slog.Level, format string, omitTime bool) *slog.Logger {
+	hopts := &slog.HandlerOptions{Level: level}
+	if omitTime {
+		hopts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(stdoutWriter{}, hopts))
+	}
+	return slog.New(slog.NewTextHandler(stdoutWriter{}, hopts))
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown -log-level %q (want debug, info, warn or error)", s)
+}
+
+func parseLogFormat(s string) (string, error) {
+	switch f := strings.ToLower(strings.TrimSpace(s)); f {
+	case "text", "json":
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown -log-format %q (want text or json)", s)
+}
+
+// stdoutWriter writes to the current os.Stdout, which -ci swaps for a pipe after startup.
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	if bar := activeProgress.Load(); bar != nil {
+		bar.clear()
+		defer bar.redraw()
+	}
+	return os.Stdout.Write(p)
+}
+
+// fatal logs msg at error level and exits with exitFatal.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	exit(exitFatal)
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/chebread/lx/pkg/lxerr"
 )
 
 var version = "dev"
 
+// spanRoot holds the span of the current run; the pipeline stages start their spans under it.
+var spanRoot = context.Background()
+
 func main() {
 	var startTime = time.Now()
 
@@ -23,76 +32,366 @@ func main() {
 
 	flag.BoolVar(&showVersion, "version", false, "Print version")
 	flag.DurationVar(&opts.timeout, "timeout", 5*time.Minute, "Timeout for `go run` capture phase")
+	flag.DurationVar(&opts.genTimeout, "gen-timeout", 2*time.Minute, "Timeout for generating one function, including compile-check retries")
 	flag.BoolVar(&opts.showStdout, "show-stdout", false, "Print target program stdout (excluding lx trace lines)")
 	flag.IntVar(&opts.maxPromptChars, "max-prompt", 4096, "Max characters of prompt sent to LLM (runtime captured input)")
 	flag.IntVar(&opts.maxBodyChars, "max-context", 8192, "Max characters of existing function body context sent to LLM")
 	flag.IntVar(&opts.maxOutputBytes, "max-output", 32*1024, "Max bytes of sample output JSON sent to LLM")
 	flag.StringVar(&opts.tags, "tags", "", "Build tags to pass to `go run` capture phase (e.g. 'mock')")
+	flag.BoolVar(&opts.explain, "explain", false, "Ask the LLM to add inline comments explaining non-trivial steps")
+	flag.IntVar(&opts.maxTurns, "max-turns", 1, "LLM turns per function; with -explain, 2 generates first and comments in a second call")
+	flag.IntVar(&opts.funcsPerCall, "functions-per-llm-call", 1, "Number of functions generated together in a single LLM request")
+	flag.BoolVar(&opts.skipCompileCheck, "skip-compile-check", false, "Write generated code without checking that the package still builds (lx.MustCompile functions are still checked)")
+	flag.IntVar(&opts.maxRetries, "max-retries", 2, "Regenerate up to N times when generated code fails the compile check")
+	flag.StringVar(&opts.formatter, "formatter", "", "Formatter run on generated files: goimports or gofmt (overrides config)")
+	flag.BoolVar(&opts.interactive, "interactive", false, "Show a diff and ask y/n/e before writing each generated body")
+	flag.BoolVar(&opts.interactive, "i", false, "Shorthand for -interactive")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "Print a diff of every change instead of writing files (exit 1 if changes are pending)")
+	flag.StringVar(&opts.only, "only", "", "Only generate the functions matching the name (exact, glob such as 'LX_*', or substring) or 'file:path' for every function in a file")
+	flag.StringVar(&opts.excludeFiles, "exclude-files", "", "Comma-separated file name globs to leave alone, e.g. \"*.pb.go,mock_*\"")
+	flag.StringVar(&opts.excludeDirs, "exclude-dirs", "", "Comma-separated directory name globs to leave alone, e.g. \"testdata,gen*\"")
+	flag.StringVar(&opts.exclude, "exclude", "", "Comma-separated function name patterns to skip (wins over -only)")
+	flag.StringVar(&opts.cacheDir, "cache-dir", defaultCacheDir(), "Directory for cached LLM responses (empty disables the cache)")
+	flag.DurationVar(&opts.cacheTTL, "cache-ttl", 24*time.Hour, "How long cached LLM responses stay fresh")
+	flag.Float64Var(&opts.temperature, "temperature", -1, "LLM sampling temperature (overrides config; negative keeps config/provider default)")
+	flag.Float64Var(&opts.topP, "top-p", -1, "LLM nucleus sampling top-p (overrides config; negative keeps config/provider default)")
+	flag.IntVar(&opts.llmRetries, "llm-retries", 3, "Max attempts per LLM call on transient errors (rate limits, 5xx, connection)")
+	flag.IntVar(&opts.maxTargets, "max-targets", 0, "Generate at most N targets per run, taken in file and function name order (0 = all)")
+	flag.StringVar(&opts.ipcSocket, "ipc-socket", "", "Stream a JSON event per finished function to clients of this Unix domain socket (see PROTOCOL.md)")
+	flag.IntVar(&opts.parallelism, "parallelism", 2, "Number of concurrent LLM generations (1-16; 1 is serial)")
+	flag.BoolVar(&opts.strictVet, "strict-vet", false, "Treat go vet findings on generated code as failures (retried like compile errors)")
+	flag.StringVar(&opts.testRun, "test-run", "TestLxCapture", "Test name pattern passed to go test -run when lx.Gen is used in _test.go files")
+	flag.BoolVar(&opts.saveTraces, "save-traces", false, "Save captured traces to lx-traces.json in the target directory")
+	flag.StringVar(&opts.loadTraces, "load-traces", "", "Skip the capture run and read traces from this file (see -save-traces)")
+	flag.BoolVar(&opts.watch, "watch", false, "After the first run, re-run the pipeline whenever a .go file under the target changes")
+	flag.BoolVar(&opts.genTests, "gen-tests", false, "Also generate a table-driven <file>_lx_test.go for each generated function")
+	flag.BoolVar(&opts.verify, "verify", false, "Run the package's tests after writing each function; failures are retried like compile errors")
+	flag.IntVar(&opts.minBodyLines, "min-body-lines", defaultMinBodyLines, "Skip functions whose body already has more than N lines of code besides lx calls")
+	flag.BoolVar(&opts.force, "force", false, "Generate even when the existing body looks like real code (see -min-body-lines)")
+	flag.BoolVar(&opts.regen, "regen", false, "Regenerate functions that already carry an // lx-prompt: comment")
+	flag.BoolVar(&opts.includeCallers, "include-callers", false, "Add up to 5 call sites of each target function to the prompt")
+	flag.IntVar(&opts.candidates, "candidates", 1, "Generate N candidate bodies per function and write the best-scoring one")
+	flag.BoolVar(&opts.autoDeps, "auto-deps", false, "Run go get for packages named in // lx-dep: comments, then go mod tidy")
+	flag.StringVar(&opts.outputJSON, "output-json", "", "Write a JSON summary of every generation result to this file")
+	flag.Float64Var(&opts.costLimit, "cost-limit", 0, "Skip the remaining generations once the estimated input cost of the run would exceed this many dollars (0 = no limit)")
+	flag.IntVar(&opts.requestsPerMinute, "requests-per-minute", 60, "Maximum LLM requests per minute (0 = unlimited)")
+	flag.BoolVar(&opts.dedupTraces, "dedup-traces", false, "Keep only the first trace of each unique (function, kind, value) during capture")
+	flag.BoolVar(&opts.buildBinary, "build-binary", false, "Compile each entry point with go build and run the binary instead of go run during capture; with -watch, unchanged entry points reuse their binary")
+	flag.StringVar(&opts.binary, "binary", "", "Capture by running this pre-built binary (go build -tags lx) instead of instrumenting and go run")
+	flag.StringVar(&opts.runArgs, "run-args", "", "Shell-quoted arguments passed to every entry point during capture, e.g. \"-v --name 'a b'\"")
+	flag.StringVar(&opts.stdinFixture, "stdin-fixture", "", "File piped to the stdin of every entry point during capture (\"-\" relays lx's stdin)")
+	flag.StringVar(&opts.stdinFixture, "run-stdin", "", "Alias of -stdin-fixture")
+	flag.StringVar(&opts.stdinText, "stdin-text", "", "Text (plus a newline) piped to the stdin of every entry point during capture")
+	flag.IntVar(&opts.contextLines, "context-lines", 0, "Include N source lines before and after the function in the prompt")
+	flag.IntVar(&opts.contextDepth, "context-depth", 0, "Include the source of the project functions a target calls, N levels of calls deep, in the prompt")
+	flag.StringVar(&opts.logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&opts.logFormat, "log-format", "text", "Log format: text or json")
+	flag.StringVar(&opts.profileCPU, "profile-cpu", "", "Write a CPU profile of the generation run to this file (inspect with go tool pprof)")
+	flag.StringVar(&opts.profileMem, "profile-mem", "", "Write a heap profile taken after the generation run to this file")
+	flag.IntVar(&opts.maxTracesPerFunc, "max-traces-per-function", 100, "Stop recording traces for a function after N of them during capture (0 = unlimited)")
+	flag.BoolVar(&opts.simulate, "simulate", false, "Do not run the program; feed each target a synthetic trace (its prompt as input, 42 as output). With -dry-run, print every prompt instead of calling the LLM")
+	flag.BoolVar(&opts.sanitizePrompt, "sanitize-prompt", false, "Replace emails, card numbers and IP addresses (or the config's sanitize_patterns) in prompts with [REDACTED]")
+	flag.BoolVar(&opts.initSafe, "init-safe", false, "During capture, run lx.Gen stubs without their panic calls and with a zero-value return, so init() code calling them cannot panic")
+	flag.BoolVar(&opts.yes, "yes", false, "Answer yes to setup questions, such as running go get when go.mod does not require lx")
+	flag.BoolVar(&opts.noSpy, "no-spy", false, "Do not run the program; generate from the lx.Gen prompts and signatures alone")
+	flag.BoolVar(&opts.skipRevert, "skip-revert", false, "Debugging: leave the instrumented sources in place after capture (restore with lx rollback)")
+	flag.BoolVar(&opts.otel, "otel", false, "Export OpenTelemetry spans of the run to OTEL_EXPORTER_OTLP_ENDPOINT (needs a build with -tags otel)")
+	flag.BoolVar(&opts.ci, "ci", false, "CI mode: timestamped plain log lines and exit codes 0 (all generated), 2 (some failed), 3 (no targets), 1 (fatal)")
+	flag.Usage = usage
 	flag.Parse()
 
+	level, err := parseLogLevel(opts.logLevel)
+	if err != nil {
+		fatal(err.Error())
+	}
+	format, err := parseLogFormat(opts.logFormat)
+	if err != nil {
+		fatal(err.Error())
+	}
+	logger = newLogger(level, format, opts.ci)
+	slog.SetDefault(logger)
+
+	if opts.ci {
+		enableCIOutput()
+		opts.githubAnnotations = os.Getenv("GITHUB_ACTIONS") == "true"
+	}
+
 	if showVersion {
 		fmt.Printf("lx %s\n", version)
 		return
 	}
 
+	if args := flag.Args(); len(args) > 0 && args[0] == "init" {
+		if err := runInit(args[1:]); err != nil {
+			fatal("Init error", "err", err)
+		}
+		return
+	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "rollback" {
+		if err := runRollback(args[1:]); err != nil {
+			fatal("Rollback error", "err", err)
+		}
+		return
+	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "clean" {
+		if err := runClean(args[1:]); err != nil {
+			fatal("Clean error", "err", err)
+		}
+		return
+	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "scan" {
+		if err := runScan(args[1:]); err != nil {
+			fatal("Scan error", "err", err)
+		}
+		return
+	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "status" {
+		if err := runStatus(args[1:]); err != nil {
+			fatal("Status error", "err", err)
+		}
+		return
+	}
+
+	if args := flag.Args(); len(args) > 0 && (args[0] == "check" || args[0] == "validate-config") {
+		if err := runCheck(opts, args[1:]); err != nil {
+			fatal(err.Error())
+		}
+		return
+	}
+
 	opts.targetDir = "."
 	if args := flag.Args(); len(args) > 0 {
 		opts.targetDir = args[0]
 	}
+	if opts.runArgv, err = splitShellArgs(opts.runArgs); err != nil {
+		fatal("invalid -run-args", "err", err)
+	}
+	if opts.stdinData, err = loadStdinFixture(opts.stdinFixture, opts.stdinText); err != nil {
+		fatal("stdin fixture", "err", err)
+	}
+	if opts.binary != "" {
+		if opts.binary, err = filepath.Abs(opts.binary); err == nil {
+			_, err = os.Stat(opts.binary)
+		}
+		if err != nil {
+			fatal("invalid -binary", "err", err)
+		}
+	}
 
 	cfg, configInfo, err := loadConfig()
 	if err != nil {
-		log.Fatalf("[lx] Config Error: %v", err)
+		fatal("Config error", "err", redact(err.Error(), redactSecret))
+	}
+	if cfg.ApiKey != "" {
+		redactSecret = cfg.ApiKey
+	}
+	if opts.filter, err = newPathFilter(opts.excludeFiles, opts.excludeDirs, cfg.ExcludeDirs, opts.tags); err != nil {
+		fatal(err.Error())
+	}
+	if opts.sanitizePrompt {
+		if opts.sanitizers, err = compileSanitizePatterns(cfg.SanitizePatterns); err != nil {
+			fatal("Config error", "err", err)
+		}
 	}
 
-	llm, err := newLLM(cfg)
-	if err != nil {
-		log.Fatalf("[lx] LLM init error: %v", err)
+	opts.formatter = resolveFormatter(opts.formatter, cfg.Formatter)
+
+	if opts.temperature >= 0 {
+		t := float32(opts.temperature)
+		cfg.Temperature = &t
+	}
+	if opts.topP >= 0 {
+		p := float32(opts.topP)
+		cfg.TopP = &p
 	}
 
-	fmt.Println("[lx] Start running...")
-	fmt.Printf("[lx] Config: %s\n", configInfo)
-	fmt.Printf("[lx] Provider: [%s] / Model: [%s]\n", cfg.Provider, cfg.Model)
+	cfg.RequestsPerMinute = opts.requestsPerMinute
+	var llm LLM = promptPrinterLLM{}
+	if !opts.simulate || !opts.dryRun {
+		var err error
+		if llm, err = newLLM(cfg); err != nil {
+			fatal("LLM init error", "err", redact(err.Error(), redactSecret))
+		}
+	}
+	llm = &retryingLLM{llm: llm, maxAttempts: opts.llmRetries}
+	if opts.costLimit > 0 {
+		llm = &costLimitedLLM{llm: llm, cfg: cfg, limit: opts.costLimit}
+	}
+	if opts.cacheDir != "" {
+		cached := newCachedLLM(llm, opts.cacheDir, opts.cacheTTL)
+		cached.refresh = opts.regen
+		llm = cached
+	}
+	// The run's token total is kept here, from the usage each call returns.
+	usage := &usageCounter{llm: llm}
+	llm = usage
+
+	logger.Info("Start running...", "config", configInfo, "provider", cfg.Provider, "model", cfg.Model)
+
+	// The capture run needs the lx package in go.mod; without it the instrumented code cannot build.
+	if !opts.noSpy && !opts.simulate && opts.loadTraces == "" && opts.binary == "" && len(scanProjectForLx(opts.targetDir, opts.filter)) > 0 {
+		if err := ensureLxModule(opts.targetDir, opts.yes); err != nil {
+			fatal("lx module missing", "err", err)
+		}
+	}
 
-	fmt.Println("[lx] Converting code")
-	backups, err := injectSpyCode(opts.targetDir)
+	stopProfiling, err := startProfiling(opts.profileCPU, opts.profileMem)
 	if err != nil {
-		fmt.Printf("[lx] Conversion failed: %v\n", err)
-		revertCode(backups)
-		return
+		fatal(err.Error())
+	}
+	stopTracing := func() {}
+	if opts.otel {
+		if stopTracing, err = startTracing(); err != nil {
+			fatal(err.Error())
+		}
+	}
+	stopEvents, err := startEventServer(opts.ipcSocket)
+	if err != nil {
+		fatal("ipc socket", "err", err)
+	}
+	var endRun func()
+	spanRoot, endRun = startSpan(context.Background(), "lx")
+	summary, err := runPipeline(opts, llm, cfg, false)
+	endRun()
+	stopTracing()
+	stopProfiling()
+	if errors.As(err, new(*lxerr.ErrNoTargets)) {
+		err = nil
+	}
+	if err != nil {
+		stopEvents()
+		fatal("Stop", "err", redact(err.Error(), redactSecret))
 	}
 
-	setupSafeExit(backups)
+	var elapsed = time.Since(startTime)
+	logger.Info("All tasks completed", "elapsed", elapsed)
+	printTokenUsage(cfg, usage.usage())
 
-	defer func() {
+	if opts.watch {
+		watchAndRerun(opts.targetDir, opts.filter, func() {
+			start := time.Now()
+			pendingChanges.Store(0)
+			_, err := runPipeline(opts, llm, cfg, true)
+			if errors.As(err, new(*lxerr.ErrNoTargets)) {
+				err = nil
+			}
+			if err != nil {
+				logger.Error("Stop", "err", redact(err.Error(), redactSecret))
+				return
+			}
+			logger.Info("All tasks completed", "elapsed", time.Since(start))
+			printTokenUsage(cfg, usage.usage())
+		})
+		removeCaptureBinaries()
+		return
+	}
 
-		if len(backups) > 0 {
-			revertCode(backups)
-		}
-	}()
+	stopEvents()
 
-	fmt.Println("[lx] Run the program and collect data")
-	traces, err := runAndCapture(opts, opts.targetDir)
+	if opts.dryRun && pendingChanges.Load() > 0 {
+		logger.Info("Dry run: changes pending", "changes", pendingChanges.Load())
+		exit(exitFatal)
+	}
 
-	fmt.Println("[lx] Restore the source code")
-	revertCode(backups)
-	clear(backups)
+	if opts.ci {
+		exit(ciExitCode(summary))
+	}
+}
 
-	if err != nil {
-		revertCode(backups)
-		log.Fatalf("\n[lx] Stop: Execution failed. Fix your Go code first.\nError: %v", err)
+func ciExitCode(summary []GenerationResult) int {
+	if len(summary) == 0 {
+		logger.Warn("CI: no targets found")
+		return exitNoTargets
+	}
+	failed := 0
+	for _, r := range summary {
+		if r.failed() {
+			failed++
+		}
 	}
+	if failed > 0 {
+		logger.Error("CI: targets failed", "failed", failed, "total", len(summary))
+		return exitFailed
+	}
+	return exitOK
+}
 
-	fmt.Println("[lx] Analyze the collected data and generating code")
-	targets := scanAndMerge(opts.targetDir, traces)
+// runPipeline runs one capture-and-generate pass. rerun is set for passes triggered by -watch.
+func runPipeline(opts options, llm LLM, cfg *Config, rerun bool) ([]GenerationResult, error) {
+	var traces []TraceData
+	if opts.noSpy {
+		logger.Info("-no-spy: skipping the capture run; generating from the lx.Gen prompts in the source")
+	} else if opts.simulate {
+		logger.Info("-simulate: skipping the capture run; using synthetic traces")
+		traces = simulateTraces(opts.targetDir, opts.filter)
+	} else if opts.loadTraces != "" {
+		logger.Info("Load traces (skipping the capture run)", "file", opts.loadTraces)
+		var err error
+		traces, err = loadTracesFromFile(opts.loadTraces)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load traces: %w", err)
+		}
+	} else {
+		var err error
+		traces, err = captureTraces(opts)
+		if err != nil {
+			return nil, err
+		}
+		if opts.saveTraces {
+			path := filepath.Join(opts.targetDir, tracesFileName)
+			if err := saveTracesToFile(path, traces); err != nil {
+				logger.Warn("failed to save traces", "err", err)
+			} else {
+				logger.Info("Saved traces", "count", len(traces), "file", path)
+			}
+		}
+		if opts.skipRevert {
+			// Generating into instrumented files would bake the spies into the result.
+			logger.Warn("-skip-revert: stopping before code generation")
+			return nil, nil
+		}
+	}
+
+	logger.Info("Analyze the collected data and generating code")
+	var targets []TargetInfo
+	if opts.noSpy {
+		targets = scanProjectForLx(opts.targetDir, opts.filter)
+	} else {
+		targets = scanAndMerge(opts.targetDir, opts.filter, traces, opts.binary != "")
+	}
+	targets = filterTargets(targets, opts.only, opts.exclude)
+	if !opts.regen {
+		targets = skipGeneratedFuncs(targets)
+	}
+	if rerun {
+		targets = skipAlreadyGenerated(targets)
+	}
+	targets = limitTargets(targets, opts.maxTargets)
 	if len(targets) == 0 {
-		fmt.Println("[lx] No conversion target")
-		return
+		logger.Info("No conversion target")
+		if opts.outputJSON != "" {
+			if err := writeResultsJSON(opts.outputJSON, nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, &lxerr.ErrNoTargets{Dir: opts.targetDir}
 	}
 
 	var wg sync.WaitGroup
+	results := make(chan GenerationResult, len(targets))
+
+	opts.parallelism = max(1, min(opts.parallelism, 16))
+	if opts.interactive && !opts.dryRun {
+		opts.parallelism = 1
+	}
+	semaphore := make(chan struct{}, opts.parallelism)
 
-	semaphore := make(chan struct{}, 2)
+	// Interactive review prompts would be overwritten by the bar.
+	tick, stopProgress := startProgress(len(targets), !opts.interactive || opts.dryRun)
 
 	fileLocks := make(map[string]*sync.Mutex)
 	for _, t := range targets {
@@ -101,34 +400,190 @@ func main() {
 		}
 	}
 
-	for _, target := range targets {
-		wg.Add(1)
+	batches, err := buildDependencyGraph(opts.targetDir, targets)
+	if err != nil {
+		logger.Warn("dependency order unavailable, generating all targets at once", "err", err)
+		batches = [][]TargetInfo{targets}
+	} else if len(batches) > 1 {
+		logger.Info("Generating in dependency order", "batches", len(batches))
+	}
+
+	// Each batch waits for the previous one, so callers see the bodies of the targets they call.
+	for _, batch := range batches {
+		if opts.funcsPerCall > 1 {
+			for start := 0; start < len(batch); start += opts.funcsPerCall {
+				end := min(start+opts.funcsPerCall, len(batch))
+				wg.Add(1)
+
+				go func(group []TargetInfo) {
+					defer wg.Done()
+
+					semaphore <- struct{}{}
+					defer func() { <-semaphore }()
+
+					defer func() { tick <- len(group) }()
+					reported := make([]bool, len(group))
+					defer recoverBatch(opts, results, group, reported, time.Now())
+
+					processBatch(opts, llm, cfg, group, reported, fileLocks, results)
+				}(batch[start:end])
+			}
+		} else {
+			for _, target := range batch {
+				wg.Add(1)
+
+				go func(t TargetInfo) {
+					defer wg.Done()
+
+					semaphore <- struct{}{}
+					defer func() { <-semaphore }()
+
+					defer func() { tick <- 1 }()
+					defer recoverGeneration(opts, results, t, time.Now())
 
-		go func(t TargetInfo) {
-			defer wg.Done()
+					fileMu := fileLocks[t.FilePath]
 
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+					processSingleTarget(opts, llm, cfg, t, fileMu, results)
+				}(target)
+			}
+		}
+		wg.Wait()
+	}
+	stopProgress()
+	close(results)
 
-			fileMu := fileLocks[t.FilePath]
+	if opts.autoDeps && !opts.dryRun {
+		tidyModules()
+	}
 
-			processSingleTarget(opts, llm, cfg, t, fileMu)
-		}(target)
+	var summary []GenerationResult
+	for r := range results {
+		summary = append(summary, r)
+	}
+	if opts.outputJSON != "" {
+		if err := writeResultsJSON(opts.outputJSON, summary); err != nil {
+			logger.Warn("failed to write results", "file", opts.outputJSON, "err", err)
+		}
 	}
 
-	wg.Wait()
+	skipped := 0
+	for _, r := range summary {
+		if strings.Contains(r.Error, errCostLimit.Error()) {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		return summary, fmt.Errorf("cost limit of $%g reached: %d of %d functions skipped", opts.costLimit, skipped, len(summary))
+	}
 
-	var elapsed = time.Since(startTime)
-	fmt.Printf("[lx] All tasks completed in %s\n", elapsed)
+	return summary, nil
 }
 
-func setupSafeExit(backups map[string]fileBackup) {
+func setupSafeExit(root string, backups map[string]fileBackup, skipRevert bool) (stop func()) {
 	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-c
-		fmt.Println("\n[lx] Forced termination detected. Restoring source code...")
+		select {
+		case <-c:
+			removeCaptureBinaries()
+			if skipRevert {
+				warnInstrumentedSources()
+				os.Exit(1)
+			}
+			logger.Warn("Forced termination detected. Restoring source code...")
+			revertCode(backups)
+			removeBackupFile(root)
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+func captureTraces(opts options) ([]TraceData, error) {
+	if hasTestTargets(scanProjectForLx(opts.targetDir, opts.filter)) {
+		opts.testMode = true
+		logger.Info("lx.Gen found in _test.go files; capturing them with go test", "run", opts.testRun)
+	}
+
+	if opts.binary != "" {
+		logger.Info("Run the pre-built binary and collect data", "binary", opts.binary)
+		traces, err := runAndCapture(opts, opts.targetDir)
+		if err != nil {
+			return nil, fmt.Errorf("execution failed, fix your Go code first: %w", err)
+		}
+		return traces, nil
+	}
+
+	logger.Info("Converting code")
+	_, endInject := startSpan(spanRoot, "inject")
+	backups, err := injectSpyCode(opts.targetDir, opts.filter, opts.tags, opts.initSafe, func(path, name, recv string) bool {
+		return funcSelected(path, name, recv, opts.only, opts.exclude)
+	})
+	endInject()
+	if err != nil {
 		revertCode(backups)
-		os.Exit(1)
+		removeBackupFile(opts.targetDir)
+		return nil, fmt.Errorf("conversion failed: %w", err)
+	}
+
+	stopSafeExit := setupSafeExit(opts.targetDir, backups, opts.skipRevert)
+	defer stopSafeExit()
+
+	defer func() {
+
+		if len(backups) > 0 && !opts.skipRevert {
+			revertCode(backups)
+		}
 	}()
+
+	logger.Info("Run the program and collect data")
+	traces, err := runAndCapture(opts, opts.targetDir)
+
+	if opts.skipRevert {
+		warnInstrumentedSources()
+	} else {
+		logger.Info("Restore the source code")
+		revertCode(backups)
+		removeBackupFile(opts.targetDir)
+	}
+	remapTraceLines(traces, backups)
+	clear(backups)
+
+	if errors.Is(err, errNoEntryPoint) && hasExamplePairs(scanProjectForLx(opts.targetDir, opts.filter)) {
+		logger.Info("No entry point to run; using the lx.GenWithExamples pairs from the source")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("execution failed, fix your Go code first: %w", err)
+	}
+
+	return traces, nil
+}
+
+func warnInstrumentedSources() {
+	logger.Warn("WARNING: source files left in instrumented state. Run 'lx rollback' to restore.")
+}
+
+// hiddenFlags are debugging flags left out of -help.
+var hiddenFlags = map[string]bool{"skip-revert": true}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		visible.Var(f.Value, f.Name, f.Usage)
+		visible.Lookup(f.Name).DefValue = f.DefValue
+	})
+	visible.PrintDefaults()
 }
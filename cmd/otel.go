@@ -0,0 +1,52 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startTracing installs a tracer provider that exports spans over OTLP/HTTP to
+// OTEL_EXPORTER_OTLP_ENDPOINT. stop flushes the spans still buffered.
+func startTracing() (stop func(), err error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return nil, errors.New("-otel: OTEL_EXPORTER_OTLP_ENDPOINT is not set")
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "lx"))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			logger.Warn("failed to export spans", "err", err)
+		}
+	}, nil
+}
+
+// startSpan starts a span named name under the span in ctx. attrs are key/value pairs.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, func()) {
+	kv := make([]attribute.KeyValue, 0, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		kv = append(kv, attribute.String(attrs[i], attrs[i+1]))
+	}
+	ctx, span := otel.Tracer("github.com/chebread/lx").Start(ctx, name, trace.WithAttributes(kv...))
+	return ctx, func() { span.End() }
+}
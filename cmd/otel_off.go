@@ -0,0 +1,18 @@
+//go:build !otel
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Without -tags otel no OpenTelemetry package is linked and spans are no-ops.
+
+func startTracing() (stop func(), err error) {
+	return nil, errors.New("-otel: lx was built without OpenTelemetry support (rebuild with -tags otel)")
+}
+
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, func()) {
+	return ctx, func() {}
+}
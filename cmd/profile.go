@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts a CPU profile written to cpuPath and arranges for a heap profile
+// to be written to memPath. Either path may be empty. stop finishes both profiles.
+func startProfiling(cpuPath, memPath string) (stop func(), err error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		cpuFile, err = os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("-profile-cpu: %w", err)
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("-profile-cpu: %w", err)
+		}
+	}
+
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+			logger.Info("CPU profile written", "file", cpuPath)
+		}
+		if memPath != "" {
+			if err := writeHeapProfile(memPath); err != nil {
+				logger.Warn("failed to write memory profile", "file", memPath, "err", err)
+				return
+			}
+			logger.Info("Memory profile written", "file", memPath)
+		}
+	}, nil
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Up-to-date statistics for the allocations made during the run.
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
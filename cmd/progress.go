@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const progressWidth = 20
+
+// progressBar draws a single self-overwriting line on stderr while functions are generated.
+type progressBar struct {
+	mu    sync.Mutex
+	total int
+	done  int
+	start time.Time
+	shown bool
+}
+
+// activeProgress is the bar currently on screen, if any. Log output clears it before
+// writing so the two never share a line.
+var activeProgress atomic.Pointer[progressBar]
+
+// startProgress shows a progress bar for total functions when enabled and stderr is a terminal. Each
+// value sent on tick marks that many functions as finished; stop draws the final state and
+// releases the line. On a non-terminal stderr nothing is drawn and the log lines stand alone.
+func startProgress(total int, enabled bool) (tick chan<- int, stop func()) {
+	ch := make(chan int, total)
+	if !enabled || total < 2 || !isTerminal(os.Stderr) {
+		go func() {
+			for range ch {
+			}
+		}()
+		return ch, func() { close(ch) }
+	}
+
+	p := &progressBar{total: total, start: time.Now()}
+	activeProgress.Store(p)
+	p.redraw()
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case n, ok := <-ch:
+				if !ok {
+					return
+				}
+				p.mu.Lock()
+				p.done = min(p.done+n, p.total)
+				p.mu.Unlock()
+				p.redraw()
+			case <-ticker.C:
+				p.redraw()
+			}
+		}
+	}()
+
+	return ch, func() {
+		close(ch)
+		<-finished
+		activeProgress.Store(nil)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.shown {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+func (p *progressBar) redraw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(os.Stderr, "\r\033[K"+p.line())
+	p.shown = true
+}
+
+// clear erases the bar so the caller can write a full line; redraw puts it back.
+func (p *progressBar) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+}
+
+func (p *progressBar) line() string {
+	filled := p.done * progressWidth / p.total
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		if filled > 0 {
+			bar = bar[:filled-1] + ">"
+		}
+		bar += strings.Repeat(" ", progressWidth-filled)
+	}
+
+	eta := "--"
+	if p.done > 0 && p.done < p.total {
+		elapsed := time.Since(p.start)
+		eta = (elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)).Round(time.Second).String()
+	} else if p.done == p.total {
+		eta = "0s"
+	}
+	return fmt.Sprintf("[lx] [%s] %d/%d functions (ETA %s)", bar, p.done, p.total, eta)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/chebread/lx/pkg/lxerr"
+)
+
+func newGenerationResult(target TargetInfo, lines int, err error, start time.Time) GenerationResult {
+	r := GenerationResult{
+		FilePath:       target.FilePath,
+		FuncName:       qualifiedFuncName(target.FuncName, target.ReceiverType),
+		Status:         "success",
+		LinesGenerated: lines,
+		DurationMs:     time.Since(start).Milliseconds(),
+	}
+	switch {
+	case errors.Is(err, errSkipped):
+		r.Status = "skipped"
+		r.Error = redact(err.Error(), redactSecret)
+	case err != nil:
+		r.Status = "failed"
+		if name := lxerr.TypeName(err); name != "" {
+			r.Status += ":" + name
+		}
+		r.Error = redact(err.Error(), redactSecret)
+	}
+	return r
+}
+
+// failed reports whether the function could not be generated. Its Status is "failed", or
+// "failed:<type>" when the cause is an lxerr error such as lxerr.ErrCompileFailed.
+func (r GenerationResult) failed() bool {
+	return r.Status == "failed" || strings.HasPrefix(r.Status, "failed:")
+}
+
+func sendResult(opts options, results chan<- GenerationResult, r GenerationResult) {
+	if opts.githubAnnotations && r.failed() {
+		annotateFailure(r)
+	}
+	emitResultEvent(r)
+	results <- r
+}
+
+// writeResultsJSON writes results to path with writeFileAtomic, so readers never see a
+// partial file.
+func writeResultsJSON(path string, results []GenerationResult) error {
+	if results == nil {
+		results = []GenerationResult{}
+	}
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const backupFileName = "lx-backup.json"
+
+type backupEntry struct {
+	Data []byte      `json:"data"`
+	Mode fs.FileMode `json:"mode"`
+}
+
+func saveBackupFile(root string, backups map[string]fileBackup) error {
+	entries := make(map[string]backupEntry, len(backups))
+	for path, b := range backups {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		entries[abs] = backupEntry{Data: b.Data, Mode: b.Mode}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(root, backupFileName), data, 0o600)
+}
+
+func removeBackupFile(root string) {
+	if err := os.Remove(filepath.Join(root, backupFileName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("failed to remove backup file", "file", backupFileName, "err", err)
+	}
+}
+
+func runRollback(args []string) error {
+	fset := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+
+	root := "."
+	if fset.NArg() > 0 {
+		root = fset.Arg(0)
+	}
+	path := filepath.Join(root, backupFileName)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no %s in %s: nothing to roll back (lx removes it after a clean restore)", backupFileName, root)
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries map[string]backupEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	failed := 0
+	for file, e := range entries {
+		if err := writeFileAtomic(file, e.Data, e.Mode); err != nil {
+			logger.Error("restore failed", "file", file, "err", err)
+			failed++
+			continue
+		}
+		logger.Info("Restored", "file", file)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be restored; %s kept", failed, path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	logger.Info("Rollback complete", "files", len(entries))
+	return nil
+}
@@ -2,18 +2,29 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go/parser"
 	"go/token"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/chebread/lx/pkg/lxerr"
 )
 
+var errNoEntryPoint = errors.New("no executable 'package main' found")
+
 func runAndCapture(opts options, rootDir string) ([]TraceData, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
 	defer cancel()
@@ -23,13 +34,22 @@ func runAndCapture(opts options, rootDir string) ([]TraceData, error) {
 		return nil, err
 	}
 
-	entryPoints, err := findMainPackages(absRoot)
+	entryPoints, err := findMainPackages(absRoot, opts.filter)
 	if err != nil {
 		return nil, fmt.Errorf("failed to scan for main packages: %w", err)
 	}
 
-	if len(entryPoints) == 0 {
-		return nil, fmt.Errorf("no executable 'package main' found under %s", rootDir)
+	if opts.binary != "" {
+		return runPrebuiltBinary(ctx, opts, absRoot, entryPoints)
+	}
+
+	var testDirs []string
+	if opts.testMode {
+		testDirs = testTargetDirs(scanProjectForLx(absRoot, opts.filter))
+	}
+
+	if len(entryPoints) == 0 && len(testDirs) == 0 {
+		return nil, fmt.Errorf("%w under %s", errNoEntryPoint, rootDir)
 	}
 
 	goExe, err := exec.LookPath("go")
@@ -38,7 +58,7 @@ func runAndCapture(opts options, rootDir string) ([]TraceData, error) {
 	}
 
 	var allTraces []TraceData
-	var executionErrors []string
+	var failed captureErrors
 
 	for _, dir := range entryPoints {
 
@@ -46,43 +66,161 @@ func runAndCapture(opts options, rootDir string) ([]TraceData, error) {
 		if relDir == "" {
 			relDir = "."
 		}
-		fmt.Printf("\t[Exec] Running entry point: %s\n", relDir)
+		logger.Info("Running entry point", "dir", relDir)
 
-		traces, err := executeSinglePackage(ctx, goExe, dir, opts)
+		_, endCapture := startSpan(spanRoot, "capture", "dir", relDir)
+		traces, err := executeSinglePackage(ctx, goExe, dir, opts, false)
+		endCapture()
 		if err != nil {
-
-			executionErrors = append(executionErrors, fmt.Sprintf("%s: %v", relDir, err))
+			failed.add(relDir, err)
 			continue
 		}
 		allTraces = append(allTraces, traces...)
 	}
 
-	if len(executionErrors) > 0 {
-		errMsg := strings.Join(executionErrors, "\n\t- ")
+	for _, dir := range testDirs {
+		relDir, _ := filepath.Rel(absRoot, dir)
+		if relDir == "" {
+			relDir = "."
+		}
+		logger.Info("Running tests", "dir", relDir, "run", opts.testRun)
+
+		_, endCapture := startSpan(spanRoot, "capture", "dir", relDir, "test", "true")
+		traces, err := executeSinglePackage(ctx, goExe, dir, opts, true)
+		endCapture()
+		if err != nil {
+			failed.add(relDir+" (test)", err)
+			continue
+		}
+		allTraces = append(allTraces, traces...)
+	}
 
-		return allTraces, fmt.Errorf("execution failed in:\n\t- %s", errMsg)
+	if len(failed.errs) > 0 {
+		return allTraces, &failed
 	}
 
 	return allTraces, nil
 }
 
-func executeSinglePackage(ctx context.Context, goExe, dir string, opts options) ([]TraceData, error) {
+// runPrebuiltBinary runs the -binary program once in place of go run. It was built from
+// sources that are not instrumented, so it records what its lx calls send: the lx.Gen
+// prompts and any lx.Spy wrapper written by hand. It runs in the directory of the entry
+// point when the project has exactly one, and in root otherwise.
+func runPrebuiltBinary(ctx context.Context, opts options, root string, entryPoints []string) ([]TraceData, error) {
+	if opts.testMode {
+		logger.Warn("-binary: lx.Gen calls in _test.go files are not captured")
+	}
+	dir := root
+	if len(entryPoints) == 1 {
+		dir = entryPoints[0]
+	}
+
+	_, endCapture := startSpan(spanRoot, "capture", "binary", opts.binary)
+	traces, err := executeSinglePackage(ctx, "", dir, opts, false)
+	endCapture()
+	if err != nil {
+		var failed captureErrors
+		failed.add(filepath.Base(opts.binary), err)
+		return traces, &failed
+	}
+	return traces, nil
+}
+
+// captureErrors collects the failed capture runs, one per entry point or test package. It
+// unwraps to each of them, so errors.As finds an lxerr.ErrTimeout from any run.
+type captureErrors struct {
+	dirs []string
+	errs []error
+}
+
+func (e *captureErrors) add(dir string, err error) {
+	e.dirs = append(e.dirs, dir)
+	e.errs = append(e.errs, err)
+}
+
+func (e *captureErrors) Error() string {
+	var sb strings.Builder
+	sb.WriteString("execution failed in:")
+	for i, dir := range e.dirs {
+		fmt.Fprintf(&sb, "\n\t- %s: %v", dir, e.errs[i])
+	}
+	return sb.String()
+}
+
+func (e *captureErrors) Unwrap() []error { return e.errs }
+
+// loadStdinFixture returns the bytes fed to the program's stdin during capture, or nil.
+// A fixture of "-" relays lx's own stdin. Everything is read up front so each entry point
+// gets the same input.
+func loadStdinFixture(fixture, text string) ([]byte, error) {
+	switch {
+	case fixture != "" && text != "":
+		return nil, errors.New("use either -stdin-fixture or -stdin-text, not both")
+	case fixture == "-":
+		return io.ReadAll(os.Stdin)
+	case fixture != "":
+		return os.ReadFile(fixture)
+	case text != "":
+		return []byte(text + "\n"), nil
+	}
+	return nil, nil
+}
+
+func executeSinglePackage(ctx context.Context, goExe, dir string, opts options, test bool) ([]TraceData, error) {
 	args := []string{"run"}
+	if test {
+		args = []string{"test", "-v", "-count=1", "-run", opts.testRun}
+	}
 	if opts.tags != "" {
 		args = append(args, "-tags", opts.tags)
 	}
 	args = append(args, ".")
-	cmd := exec.CommandContext(ctx, goExe, args...)
-	cmd.Dir = dir
+	if !test {
+		args = append(args, opts.runArgv...)
+	}
 
 	secureEnv := buildSecureEnvAllowlist()
 	token := mustRandomToken(16)
 
-	cmd.Env = append(secureEnv,
+	// Traces go to a file so they never mix with the program's own stdout.
+	traceFile, err := os.CreateTemp("", "lx-traces-*.log")
+	if err != nil {
+		return nil, err
+	}
+	traceFile.Close()
+	defer os.Remove(traceFile.Name())
+
+	env := append(secureEnv,
 		"LX_MODE=capture",
 		"LX_TRACE_TOKEN="+token,
+		"LX_TRACE_FILE="+traceFile.Name(),
 		"LX_TRACE_MAX_BYTES=65536",
+		"LX_TRACE_MAX_PER_FUNC="+strconv.Itoa(opts.maxTracesPerFunc),
 	)
+	if work := findGoWork(opts.targetDir); work != "" {
+		env = append(env, "GOWORK="+work)
+	}
+
+	var cmd *exec.Cmd
+	if opts.binary != "" && !test {
+		cmd = exec.CommandContext(ctx, opts.binary, opts.runArgv...)
+	} else if opts.buildBinary && !test {
+		bin, cleanup, err := buildCaptureBinary(ctx, goExe, dir, opts.tags, env, opts.watch)
+		if err != nil {
+			logger.Warn("-build-binary failed, falling back to go run", "err", err)
+		} else {
+			defer cleanup()
+			cmd = exec.CommandContext(ctx, bin, opts.runArgv...)
+		}
+	}
+	if cmd == nil {
+		cmd = exec.CommandContext(ctx, goExe, args...)
+	}
+	cmd.Dir = dir
+	cmd.Env = env
+	if opts.stdinData != nil && !test {
+		cmd.Stdin = bytes.NewReader(opts.stdinData)
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -98,33 +236,54 @@ func executeSinglePackage(ctx context.Context, goExe, dir string, opts options)
 	endMarker := "LX_TRACE_END_" + token
 
 	var traces []TraceData
-	sc := bufio.NewScanner(stdout)
-	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-
-	for sc.Scan() {
-		line := sc.Text()
+	var seen map[traceKey]bool
+	received := 0
+	if opts.dedupTraces {
+		seen = make(map[traceKey]bool)
+	}
 
-		if strings.HasPrefix(line, startMarker) && strings.HasSuffix(line, endMarker) {
-			payload := strings.TrimSuffix(strings.TrimPrefix(line, startMarker), endMarker)
+	// readTrace records line if it is a trace line and reports whether it was one.
+	readTrace := func(line string) bool {
+		if !strings.HasPrefix(line, startMarker) || !strings.HasSuffix(line, endMarker) {
+			return false
+		}
+		payload := strings.TrimSuffix(strings.TrimPrefix(line, startMarker), endMarker)
 
-			var td TraceData
-			if err := json.Unmarshal([]byte(payload), &td); err == nil {
-				td.Function = normalizeFuncName(td.Function)
+		var td TraceData
+		if err := json.Unmarshal([]byte(payload), &td); err != nil {
+			return true
+		}
+		if td.Kind == "INPUT" || td.Kind == "ASSERT_FAIL" || td.Kind == "EXAMPLE_PAIR" {
+			td.Function = normalizeFuncName(td.Function)
+		}
 
-				if !filepath.IsAbs(td.File) {
-					td.File = filepath.Join(dir, td.File)
-				}
-				td.File = filepath.Clean(td.File)
-				traces = append(traces, td)
+		if !filepath.IsAbs(td.File) {
+			td.File = filepath.Join(dir, td.File)
+		}
+		td.File = filepath.Clean(td.File)
 
-				valPreview := safeValuePreview(td.Kind, td.Value, 50)
-				fmt.Printf("\t[%s] %s: %s\n", td.Kind, td.Function, valPreview)
+		received++
+		if seen != nil {
+			key := traceKey{function: td.Function, kind: td.Kind, value: sha256.Sum256(td.Value)}
+			if seen[key] {
+				return true
 			}
-			continue
+			seen[key] = true
 		}
+		traces = append(traces, td)
+
+		valPreview := safeValuePreview(td.Kind, td.Value, 50)
+		logger.Info("trace", "kind", td.Kind, "function", td.Function, "value", valPreview)
+		return true
+	}
 
-		if opts.showStdout {
-			fmt.Printf("\t[capture stdout] %s\n", line)
+	// Programs built against an lx without LX_TRACE_FILE support still print traces to stdout.
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if !readTrace(line) && opts.showStdout {
+			logger.Info("capture stdout", "line", line)
 		}
 	}
 
@@ -133,30 +292,226 @@ func executeSinglePackage(ctx context.Context, goExe, dir string, opts options)
 		waitErr = scanErr
 	}
 
+	if f, err := os.Open(traceFile.Name()); err == nil {
+		fsc := bufio.NewScanner(f)
+		fsc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for fsc.Scan() {
+			readTrace(fsc.Text())
+		}
+		if err := fsc.Err(); err != nil && waitErr == nil {
+			waitErr = err
+		}
+		f.Close()
+	}
+
+	if seen != nil && received > 0 {
+		logger.Info("Deduplicated traces", "received", received, "unique", len(traces))
+	}
+
 	if ctx.Err() == context.DeadlineExceeded {
-		return traces, fmt.Errorf("timeout")
+		return traces, &lxerr.ErrTimeout{Stage: "capture", After: opts.timeout}
 	}
 
 	return traces, waitErr
 }
 
-func findMainPackages(root string) ([]string, error) {
+// buildCaptureBinary compiles the package in dir into a temporary binary. cleanup removes it.
+// With keep set (-watch), the binary is kept for the next pass instead: it is reused while the
+// instrumented sources it was built from are unchanged, and removed by removeCaptureBinaries.
+func buildCaptureBinary(ctx context.Context, goExe, dir, tags string, env []string, keep bool) (bin string, cleanup func(), err error) {
+	var key string
+	if keep {
+		key = captureBinaryKey(ctx, goExe, dir, tags, env)
+		if bin := cachedCaptureBinary(dir, key); bin != "" {
+			logger.Debug("Reusing capture binary", "dir", dir)
+			return bin, func() {}, nil
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "lx-capture-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(tmpDir) }
+
+	bin = filepath.Join(tmpDir, "lx_capture_bin")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	args := []string{"build", "-o", bin}
+	if tags != "" {
+		args = append(args, "-tags", tags)
+	}
+	args = append(args, ".")
+
+	build := exec.CommandContext(ctx, goExe, args...)
+	build.Dir = dir
+	build.Env = env
+	if out, err := build.CombinedOutput(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("%w\n%s", err, strings.TrimSpace(string(out)))
+	}
+	if key != "" {
+		storeCaptureBinary(dir, captureBinary{key: key, bin: bin, tmpDir: tmpDir})
+		return bin, func() {}, nil
+	}
+	return bin, cleanup, nil
+}
+
+// captureBinary is a -build-binary build kept across -watch passes.
+type captureBinary struct {
+	key    string
+	bin    string
+	tmpDir string
+}
+
+var (
+	captureBinariesMu sync.Mutex
+	captureBinaries   = map[string]captureBinary{}
+)
+
+// cachedCaptureBinary returns the binary kept for dir if it was built for key, or "".
+func cachedCaptureBinary(dir, key string) string {
+	captureBinariesMu.Lock()
+	defer captureBinariesMu.Unlock()
+	cb, ok := captureBinaries[dir]
+	if !ok || cb.key != key {
+		return ""
+	}
+	if _, err := os.Stat(cb.bin); err != nil {
+		return ""
+	}
+	return cb.bin
+}
+
+// storeCaptureBinary keeps cb for dir and removes the binary it replaces.
+func storeCaptureBinary(dir string, cb captureBinary) {
+	captureBinariesMu.Lock()
+	defer captureBinariesMu.Unlock()
+	if old, ok := captureBinaries[dir]; ok {
+		os.RemoveAll(old.tmpDir)
+	}
+	captureBinaries[dir] = cb
+}
+
+// removeCaptureBinaries deletes every binary kept by buildCaptureBinary.
+func removeCaptureBinaries() {
+	captureBinariesMu.Lock()
+	defer captureBinariesMu.Unlock()
+	for dir, cb := range captureBinaries {
+		os.RemoveAll(cb.tmpDir)
+		delete(captureBinaries, dir)
+	}
+}
+
+// captureBinaryKey hashes what the binary for dir is built from: the build tags, the Go
+// environment and every source file of its non-standard dependencies as instrumented for
+// this pass, with the go.mod files of their modules. It returns "" if go list fails, so the
+// binary is rebuilt.
+func captureBinaryKey(ctx context.Context, goExe, dir, tags string, env []string) string {
+	args := []string{"list", "-deps", "-f", `{{if not .Standard}}{{range .GoFiles}}{{$.Dir}}/{{.}}
+{{end}}{{range .CgoFiles}}{{$.Dir}}/{{.}}
+{{end}}{{range .EmbedFiles}}{{$.Dir}}/{{.}}
+{{end}}{{with .Module}}{{.GoMod}}
+{{end}}{{end}}`}
+	if tags != "" {
+		args = append(args, "-tags", tags)
+	}
+	args = append(args, ".")
+	list := exec.CommandContext(ctx, goExe, args...)
+	list.Dir = dir
+	list.Env = env
+	out, err := list.Output()
+	if err != nil {
+		return ""
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", goExe, dir, tags)
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "GO") || strings.HasPrefix(kv, "CGO_") {
+			fmt.Fprintf(h, "%s\x00", kv)
+		}
+		if work, ok := strings.CutPrefix(kv, "GOWORK="); ok {
+			if data, err := os.ReadFile(work); err == nil {
+				h.Write(data)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, path := range strings.Split(string(out), "\n") {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", path, len(data))
+		h.Write(data)
+		if filepath.Base(path) == "go.mod" {
+			if sum, err := os.ReadFile(filepath.Join(filepath.Dir(path), "go.sum")); err == nil {
+				h.Write(sum)
+			}
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+type traceKey struct {
+	function string
+	kind     string
+	value    [sha256.Size]byte
+}
+
+const tracesFileName = "lx-traces.json"
+
+func saveTracesToFile(path string, traces []TraceData) error {
+	data, err := json.MarshalIndent(traces, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+func loadTracesFromFile(path string) ([]TraceData, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var traces []TraceData
+	if err := json.Unmarshal(data, &traces); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return traces, nil
+}
+
+func findMainPackages(root string, filter pathFilter) ([]string, error) {
 	var entryPoints []string
 	seen := make(map[string]struct{})
 
-	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+	for _, r := range projectRoots(root) {
+		if err := findMainPackagesIn(r, filter, seen, &entryPoints); err != nil {
+			return entryPoints, err
+		}
+	}
+	return entryPoints, nil
+}
+
+func findMainPackagesIn(root string, filter pathFilter, seen map[string]struct{}, entryPoints *[]string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
 		if d.IsDir() {
-			name := d.Name()
-			if name == "vendor" || name == ".git" {
+			if path != root && filter.skipDir(root, path) {
 				return filepath.SkipDir
 			}
 			return nil
 		}
 
-		if filepath.Ext(path) != ".go" {
+		if filepath.Ext(path) != ".go" || filter.skipFile(path) {
 			return nil
 		}
 
@@ -174,16 +529,18 @@ func findMainPackages(root string) ([]string, error) {
 		}
 
 		if f.Name.Name == "main" {
-			entryPoints = append(entryPoints, dir)
+			*entryPoints = append(*entryPoints, dir)
 			seen[dir] = struct{}{}
 		}
 
 		return nil
 	})
-
-	return entryPoints, err
 }
 
+// buildSecureEnvAllowlist returns the environment of the capture run: only the variables
+// listed here, so API keys and tokens in lx's own environment never reach the program.
+// GOPROXY is passed unchanged, including any credentials in its URLs, because go needs them
+// to download private modules.
 func buildSecureEnvAllowlist() []string {
 
 	allowList := []string{
@@ -203,3 +560,23 @@ func buildSecureEnvAllowlist() []string {
 	}
 	return env
 }
+
+// simulateTraces stands in for a capture run (-simulate): every target gets an INPUT trace
+// holding its lx.Gen prompt and an OUTPUT trace of 42.
+func simulateTraces(root string, filter pathFilter) []TraceData {
+	var traces []TraceData
+	for _, t := range scanProjectForLx(root, filter) {
+		file, err := filepath.Abs(t.FilePath)
+		if err != nil {
+			continue
+		}
+		name := qualifiedFuncName(t.FuncName, t.ReceiverType)
+		// The runtime prompt excludes the hints; scanAndMerge appends them again.
+		prompt, _ := json.Marshal(strings.TrimSuffix(t.Prompt, withHints("", t.Hints)))
+		traces = append(traces,
+			TraceData{Kind: "INPUT", Function: name, Value: prompt, File: file, Line: t.CallLine},
+			TraceData{Kind: "OUTPUT", Function: name, Value: json.RawMessage("42"), File: file, Line: t.CallLine},
+		)
+	}
+	return traces
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildCaptureBinaryReuse(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{"go.mod": "module example.com/m\n\ngo 1.25\n", "main.go": "package main\n\nfunc main() {}\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	defer removeCaptureBinaries()
+	env := os.Environ()
+
+	first, cleanup, err := buildCaptureBinary(ctx, "go", dir, "", env, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	second, _, err := buildCaptureBinary(ctx, "go", dir, "", env, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Errorf("unchanged sources rebuilt: %s, want %s", second, first)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() { println() }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	third, _, err := buildCaptureBinary(ctx, "go", dir, "", env, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Errorf("changed sources reused the old binary")
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("replaced binary left behind: %v", err)
+	}
+
+	removeCaptureBinaries()
+	if _, err := os.Stat(third); !os.IsNotExist(err) {
+		t.Errorf("binary left behind after removeCaptureBinaries: %v", err)
+	}
+}
+
+func TestBuildCaptureBinaryWithoutWatch(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{"go.mod": "module example.com/m\n\ngo 1.25\n", "main.go": "package main\n\nfunc main() {}\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	bin, cleanup, err := buildCaptureBinary(ctx, "go", dir, "", os.Environ(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if _, err := os.Stat(bin); !os.IsNotExist(err) {
+		t.Errorf("binary left behind after cleanup: %v", err)
+	}
+}
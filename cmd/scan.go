@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// runScan lists the lx.Gen targets under a directory. It only parses the sources: no LLM
+// is called and the program is not run.
+func runScan(args []string) error {
+	fset := flag.NewFlagSet("scan", flag.ContinueOnError)
+	format := fset.String("format", "table", "Output format: table or json")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("invalid -format %q (want table or json)", *format)
+	}
+
+	root := "."
+	if fset.NArg() > 0 {
+		root = fset.Arg(0)
+	}
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+
+	targets := scanProjectForLx(root, pathFilter{})
+	if *format == "json" {
+		if targets == nil {
+			targets = []TargetInfo{}
+		}
+		data, err := json.MarshalIndent(targets, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(data))
+		return err
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tFUNCTION\tPROMPT")
+	for _, t := range targets {
+		file := t.FilePath
+		if rel, err := filepath.Rel(absRoot, file); err == nil {
+			file = rel
+		}
+		name := qualifiedFuncName(t.FuncName, t.ReceiverType)
+		if t.Generated {
+			name += " [generated]"
+		}
+		fmt.Fprintf(w, "%s:%d\t%s\t%s\n", file, t.CallLine, name, truncateString(singleLine(t.Prompt), 60))
+	}
+	return w.Flush()
+}
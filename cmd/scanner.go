@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"go/ast"
@@ -8,12 +9,19 @@ import (
 	"go/token"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func scanAndMerge(root string, traces []TraceData) []TargetInfo {
-	rawTargets := scanProjectForLx(root)
+// scanAndMerge pairs the lx.Gen targets under root with the captured traces. A target is
+// kept once its return value was recorded; with inputOnly (-binary, where nothing was
+// instrumented) reaching its lx.Gen call is enough.
+func scanAndMerge(root string, filter pathFilter, traces []TraceData, inputOnly bool) []TargetInfo {
+	rawTargets := scanProjectForLx(root, filter)
 
 	for i := range rawTargets {
 		if abs, err := filepath.Abs(rawTargets[i].FilePath); err == nil {
@@ -21,14 +29,23 @@ func scanAndMerge(root string, traces []TraceData) []TargetInfo {
 		}
 	}
 
-	index := make(map[string]*TargetInfo, len(rawTargets))
-	finalTargets := make([]TargetInfo, 0, len(rawTargets))
+	byFunc := make(map[string][]*TargetInfo, len(rawTargets))
+	byCall := make(map[string]*TargetInfo, len(rawTargets))
+	byDir := make(map[string][]*TargetInfo, len(rawTargets))
+	byLine := make(map[string]*TargetInfo, len(rawTargets))
+	finalTargets := make([]*TargetInfo, 0, len(rawTargets))
+	captured := make(map[*TargetInfo]bool, len(rawTargets))
+	multi := make(map[string][]json.RawMessage)
 
 	for _, rt := range rawTargets {
 		rtCopy := rt
-		key := rtCopy.FuncName + "\n" + rtCopy.FilePath
-		index[key] = &rtCopy
-		finalTargets = append(finalTargets, rtCopy)
+		key := qualifiedFuncName(rtCopy.FuncName, rtCopy.ReceiverType) + "\n" + rtCopy.FilePath
+		byFunc[key] = append(byFunc[key], &rtCopy)
+		byCall[key+"\n"+strconv.Itoa(rtCopy.CallLine)] = &rtCopy
+		dirKey := rtCopy.FuncName + "\n" + filepath.Dir(rtCopy.FilePath)
+		byDir[dirKey] = append(byDir[dirKey], &rtCopy)
+		byLine[rtCopy.FilePath+"\n"+strconv.Itoa(rtCopy.CallLine)] = &rtCopy
+		finalTargets = append(finalTargets, &rtCopy)
 	}
 
 	for _, t := range traces {
@@ -36,51 +53,135 @@ func scanAndMerge(root string, traces []TraceData) []TargetInfo {
 		if abs, err := filepath.Abs(tf); err == nil {
 			tf = abs
 		}
-		key := t.Function + "\n" + tf
-		target := index[key]
-		if target == nil {
+		if t.Kind == "EXAMPLE" {
+			var s string
+			if err := json.Unmarshal(t.Value, &s); err != nil || strings.TrimSpace(s) == "" {
+				continue
+			}
+			for _, target := range byDir[t.Function+"\n"+filepath.Dir(tf)] {
+				target.Examples = uniqueStrings(append(target.Examples, s))
+			}
+			continue
+		}
+		if t.Kind == "ASSERT_FAIL" {
+			var msg string
+			if err := json.Unmarshal(t.Value, &msg); err != nil {
+				msg = string(t.Value)
+			}
+			logger.Warn("lx.Assert failed", "function", t.Function, "file", tf, "line", t.Line, "message", msg)
 			continue
 		}
 
+		key := t.Function + "\n" + tf
+
 		switch t.Kind {
 		case "INPUT":
+			target := byCall[key+"\n"+strconv.Itoa(t.Line)]
+			if target == nil && len(byFunc[key]) == 1 {
+				target = byFunc[key][0]
+			}
+			if target == nil {
+				// Function literals are traced under their runtime name, e.g. main.func1.
+				target = byLine[tf+"\n"+strconv.Itoa(t.Line)]
+			}
+			if target == nil {
+				continue
+			}
+			captured[target] = true
+
 			var s string
 			if err := json.Unmarshal(t.Value, &s); err == nil && s != "" {
-				target.Prompt = s
+				target.Prompt = withHints(s, target.Hints)
 			} else {
-				target.Prompt = string(t.Value)
+				target.Prompt = withHints(string(t.Value), target.Hints)
+			}
+		case "EXAMPLE_PAIR":
+			target := byCall[key+"\n"+strconv.Itoa(t.Line)]
+			if target == nil && len(byFunc[key]) == 1 {
+				target = byFunc[key][0]
+			}
+			if target == nil {
+				target = byLine[tf+"\n"+strconv.Itoa(t.Line)]
+			}
+			var pair struct {
+				Input  json.RawMessage `json:"input"`
+				Output json.RawMessage `json:"output"`
+			}
+			if target == nil || json.Unmarshal(t.Value, &pair) != nil {
+				continue
+			}
+			p := ExamplePair{Input: string(pair.Input), Output: string(pair.Output)}
+			if !slices.Contains(target.ExamplePairs, p) {
+				target.ExamplePairs = append(target.ExamplePairs, p)
+			}
+		case "OUTPUT_MULTI":
+			v := t.Value
+			if !json.Valid(v) {
+				v, _ = json.Marshal(string(t.Value))
+			}
+			multi[key] = append(multi[key], v)
+		case "OUTPUT_VOID":
+			output := string(t.Value)
+			var args []any
+			if err := json.Unmarshal(t.Value, &args); err == nil {
+				if pretty, err := json.MarshalIndent(args, "", "  "); err == nil {
+					output = string(pretty)
+				}
+			}
+			for _, target := range byFunc[key] {
+				target.CallArgs = output
 			}
 		case "OUTPUT":
+			output := ""
 			var anyVal any
 			if err := json.Unmarshal(t.Value, &anyVal); err == nil {
 				if pretty, err := json.MarshalIndent(anyVal, "", "  "); err == nil {
-					target.Output = string(pretty)
+					output = string(pretty)
 				}
 			} else {
 
-				target.Output = string(t.Value)
+				output = string(t.Value)
+			}
+			for _, target := range byFunc[key] {
+				target.Output = output
 			}
 		}
 	}
 
+	// lx.SpyMulti values win over the last lx.Spy value.
+	for key, values := range multi {
+		pretty, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			continue
+		}
+		for _, target := range byFunc[key] {
+			target.Output = string(pretty)
+			target.OutputCalls = len(values)
+		}
+	}
+
 	out := make([]TargetInfo, 0, len(finalTargets))
-	for _, rt := range finalTargets {
-		key := rt.FuncName + "\n" + rt.FilePath
-		cur := index[key]
-		if cur == nil || cur.Output == "" {
+	for _, cur := range finalTargets {
+		if cur.Output == "" && cur.CallArgs == "" && len(cur.ExamplePairs) == 0 && !(inputOnly && captured[cur]) {
+			continue
+		}
+		if cur.Condition != "" && !captured[cur] {
+			logger.Info("skipped: lx.GenIf condition was false during capture", "func", qualifiedFuncName(cur.FuncName, cur.ReceiverType), "condition", cur.Condition)
 			continue
 		}
 
-		fmt.Printf("\t[Data] %s: Input=\"%s\", Output=Confirmed\n", cur.FuncName, truncateString(cur.Prompt, 80))
+		logger.Info("target", "func", qualifiedFuncName(cur.FuncName, cur.ReceiverType), "input", truncateString(cur.Prompt, 80))
 		out = append(out, *cur)
 	}
 	return out
 }
 
-func scanProjectForLx(root string) []TargetInfo {
+func scanProjectForLx(root string, filter pathFilter) []TargetInfo {
 	var targets []TargetInfo
+	examples := make(map[string][]string)
+	mustCompile := make(map[string]bool)
 
-	_ = walkGoFiles(root, func(path string, d fs.DirEntry) error {
+	_ = walkGoFiles(root, filter, func(path string, d fs.DirEntry) error {
 		if d.Type()&os.ModeSymlink != 0 {
 			return nil
 		}
@@ -96,47 +197,837 @@ func scanProjectForLx(root string) []TargetInfo {
 			return nil
 		}
 
-		ast.Inspect(node, func(n ast.Node) bool {
-			fn, ok := n.(*ast.FuncDecl)
-			if !ok || fn.Body == nil {
-				return true
+		fileConfig := fileConfigOverrides(node)
+
+		for _, fn := range funcDecls(node) {
+			if fn.Body == nil {
+				continue
 			}
 
+			first := len(targets)
+			promptIndex := 0
+			var hints, imports []string
+			generated := hasLxPromptIn(node, fn)
+			litBodies := funcLitBodies(fn.Body)
+
 			ast.Inspect(fn.Body, func(inner ast.Node) bool {
+				if lit, ok := inner.(*ast.FuncLit); ok && litBodies[lit.Body] {
+					return false
+				}
 				call, ok := inner.(*ast.CallExpr)
 				if !ok {
 					return true
 				}
 
+				if isLxLangCall(call) && len(call.Args) == 2 {
+					name, ok1 := stringLiteral(call.Args[0])
+					example, ok2 := stringLiteral(call.Args[1])
+					if ok1 && ok2 && strings.TrimSpace(example) != "" {
+						key := name + "\n" + filepath.Dir(abs)
+						examples[key] = append(examples[key], example)
+					}
+				}
+
+				if isLxCall(call, "Hint") && len(call.Args) == 1 {
+					hint, ok := stringLiteral(call.Args[0])
+					if !ok {
+						hint = nodeToString(fset, call.Args[0])
+					}
+					if hint = strings.TrimSpace(hint); hint != "" {
+						hints = append(hints, hint)
+					}
+				}
+
+				if isLxCall(call, "Import") && len(call.Args) == 1 {
+					if pkg, ok := stringLiteral(call.Args[0]); ok && !slices.Contains(imports, pkg) {
+						imports = append(imports, pkg)
+					}
+				}
+
+				if isLxMustCompileCall(call) && len(call.Args) == 1 {
+					if name, ok := stringLiteral(call.Args[0]); ok {
+						mustCompile[name+"\n"+filepath.Dir(abs)] = true
+					}
+				}
+
 				if isLxGenCall(call) {
+					args := call.Args
+					condition := ""
+					if isLxCall(call, "GenIf") && len(args) > 0 {
+						condition = nodeToString(fset, args[0])
+						args = args[1:]
+					} else if isLxCall(call, "GenCtx") && len(args) > 0 {
+						args = args[1:]
+					}
+
 					prompt := ""
-					if len(call.Args) > 0 {
+					if len(args) > 0 {
 
-						if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						if lit, ok := args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
 							prompt = strings.Trim(lit.Value, "`\"")
 						}
 
 						if prompt == "" {
-							prompt = nodeToString(fset, call.Args[0])
+							prompt = nodeToString(fset, args[0])
 						}
 					}
 
+					var timeout time.Duration
+					var pairs []ExamplePair
+					if isLxCall(call, "GenWithExamples") {
+						pairs = examplePairLiterals(fset, call.Args[1:])
+					} else if condition == "" && len(args) > 1 {
+						timeout, _ = durationLiteral(args[1])
+					}
+
 					if prompt != "" {
 						targets = append(targets, TargetInfo{
-							FilePath: abs,
-							FuncName: fn.Name.Name,
-							Prompt:   prompt,
+							FilePath:     abs,
+							FuncName:     fn.Name.Name,
+							ReceiverType: receiverType(fn),
+							Prompt:       prompt,
+							Condition:    condition,
+							PromptIndex:  promptIndex,
+							CallPos:      call.Pos(),
+							CallLine:     fset.Position(call.Pos()).Line,
+							GenCall:      nodeToString(fset, call),
+							Timeout:      timeout,
+							FileConfig:   fileConfig,
+							ExamplePairs: pairs,
 						})
 					}
+					promptIndex++
 				}
 				return true
 			})
 
+			for i := first; i < len(targets); i++ {
+				targets[i].Hints = hints
+				targets[i].RequiredImports = imports
+				targets[i].Prompt = withHints(targets[i].Prompt, hints)
+			}
+
+			if promptIndex > 1 {
+				for i := first; i < len(targets); i++ {
+					targets[i].Segmented = true
+				}
+			} else if generated {
+				// A single lx.Gen replaces the whole body, including earlier generated code.
+				for i := first; i < len(targets); i++ {
+					targets[i].Generated = true
+				}
+			}
+		}
+
+		return nil
+	})
+
+	for i := range targets {
+		key := targets[i].FuncName + "\n" + filepath.Dir(targets[i].FilePath)
+		targets[i].Examples = uniqueStrings(examples[key])
+		targets[i].MustCompile = mustCompile[key]
+	}
+
+	return targets
+}
+
+// withHints appends the lx.Hint texts of a function to its prompt, one per line.
+func withHints(prompt string, hints []string) string {
+	if len(hints) == 0 {
+		return prompt
+	}
+	return prompt + "\n" + strings.Join(hints, "\n")
+}
+
+func hasLxPromptIn(file *ast.File, fn *ast.FuncDecl) bool {
+	for _, cg := range file.Comments {
+		if cg.Pos() < fn.Body.Lbrace || cg.End() > fn.Body.Rbrace {
+			continue
+		}
+		for _, c := range cg.List {
+			if strings.HasPrefix(c.Text, "// lx-prompt:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func skipGeneratedFuncs(targets []TargetInfo) []TargetInfo {
+	out := make([]TargetInfo, 0, len(targets))
+	for _, t := range targets {
+		if t.Generated {
+			logger.Info("skipped: already generated (// lx-prompt: found); use -regen to replace it", "func", qualifiedFuncName(t.FuncName, t.ReceiverType))
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// limitTargets keeps the first n targets ordered by file and function name (-max-targets),
+// so repeated runs pick the same ones. The lx.Gen calls of one function stay together even
+// if that goes past n. n <= 0 keeps every target.
+func limitTargets(targets []TargetInfo, n int) []TargetInfo {
+	if n <= 0 || len(targets) <= n {
+		return targets
+	}
+
+	key := func(t TargetInfo) string {
+		return t.FilePath + qualifiedFuncName(t.FuncName, t.ReceiverType)
+	}
+	sorted := slices.Clone(targets)
+	slices.SortStableFunc(sorted, func(a, b TargetInfo) int {
+		if c := strings.Compare(key(a), key(b)); c != 0 {
+			return c
+		}
+		return a.PromptIndex - b.PromptIndex
+	})
+
+	cut := n
+	for cut < len(sorted) && key(sorted[cut]) == key(sorted[cut-1]) {
+		cut++
+	}
+	logger.Info(fmt.Sprintf("Processing %d of %d total targets (use -max-targets 0 for all)", cut, len(targets)))
+	return sorted[:cut]
+}
+
+// skipAlreadyGenerated drops targets whose function already carries an lx-prompt
+// comment for the same prompt, so -watch re-runs leave finished bodies alone.
+func skipAlreadyGenerated(targets []TargetInfo) []TargetInfo {
+	out := make([]TargetInfo, 0, len(targets))
+	for _, t := range targets {
+		if hasLxPromptComment(t) {
+			logger.Info("skipped: already generated for this prompt", "func", qualifiedFuncName(t.FuncName, t.ReceiverType))
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+func hasLxPromptComment(t TargetInfo) bool {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, t.FilePath, nil, parser.ParseComments)
+	if err != nil {
+		return false
+	}
+	fn := findFuncDecl(file, t.FuncName, t.ReceiverType)
+	if fn == nil || fn.Body == nil {
+		return false
+	}
+
+	return hasPromptCommentIn(file, fn, t.Prompt)
+}
+
+// hasPromptCommentIn reports whether fn's body holds the // lx-prompt: comment written for prompt.
+func hasPromptCommentIn(file *ast.File, fn *ast.FuncDecl, prompt string) bool {
+	want := "// lx-prompt: " + sanitizeComment(prompt)
+	for _, cg := range file.Comments {
+		if cg.Pos() < fn.Body.Lbrace || cg.End() > fn.Body.Rbrace {
+			continue
+		}
+		for _, c := range cg.List {
+			if strings.TrimSpace(c.Text) == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasTestTargets(targets []TargetInfo) bool {
+	for _, t := range targets {
+		if strings.HasSuffix(t.FilePath, "_test.go") {
+			return true
+		}
+	}
+	return false
+}
+
+func testTargetDirs(targets []TargetInfo) []string {
+	var dirs []string
+	seen := make(map[string]struct{})
+	for _, t := range targets {
+		if !strings.HasSuffix(t.FilePath, "_test.go") {
+			continue
+		}
+		dir := filepath.Dir(t.FilePath)
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// findCallSites returns up to limit unique statements that call target, each cut to three lines.
+func findCallSites(root string, filter pathFilter, target TargetInfo, limit int) []string {
+	var sites []string
+	seen := make(map[string]bool)
+
+	_ = walkGoFiles(root, filter, func(path string, d fs.DirEntry) error {
+		if len(sites) >= limit {
+			return filepath.SkipAll
+		}
+
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return nil
+		}
+
+		var stack []ast.Node
+		ast.Inspect(file, func(n ast.Node) bool {
+			if n == nil {
+				stack = stack[:len(stack)-1]
+				return false
+			}
+			stack = append(stack, n)
+
+			if fn, ok := n.(*ast.FuncDecl); ok && fn.Name.Name == target.FuncName && receiverType(fn) == target.ReceiverType {
+				stack = stack[:len(stack)-1]
+				return false
+			}
+
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(sites) >= limit || !callsFunc(call, target.FuncName) {
+				return true
+			}
+
+			for i := len(stack) - 1; i >= 0; i-- {
+				stmt, ok := stack[i].(ast.Stmt)
+				if !ok {
+					continue
+				}
+				if _, isBlock := stmt.(*ast.BlockStmt); isBlock {
+					continue
+				}
+
+				text := nodeToString(fset, stmt)
+				if lines := strings.Split(text, "\n"); len(lines) > 3 {
+					text = strings.Join(lines[:3], "\n") + "\n..."
+				}
+				if !seen[text] {
+					seen[text] = true
+					sites = append(sites, fmt.Sprintf("// %s:%d\n%s", filepath.Base(path), fset.Position(stmt.Pos()).Line, text))
+				}
+				break
+			}
 			return true
 		})
+		return nil
+	})
+
+	return sites
+}
 
+// findCalledFuncs returns the source of the functions fn calls, and the functions those
+// call, up to depth levels, in the order they are reached (-context-depth). Calls are
+// matched to declarations in the project by name, as buildDependencyGraph does. The result
+// stops growing once it passes limit bytes.
+func findCalledFuncs(root string, filter pathFilter, path string, fn *ast.FuncDecl, depth, limit int) []string {
+	type decl struct {
+		path string
+		fset *token.FileSet
+		fn   *ast.FuncDecl
+	}
+
+	byName := make(map[string][]decl)
+	_ = walkGoFiles(root, filter, func(p string, d fs.DirEntry) error {
+		if strings.HasSuffix(p, "_test.go") {
+			return nil
+		}
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, p, nil, parser.ParseComments)
+		if err != nil {
+			return nil
+		}
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		for _, f := range funcDecls(file) {
+			if f.Body != nil {
+				byName[f.Name.Name] = append(byName[f.Name.Name], decl{path: p, fset: fset, fn: f})
+			}
+		}
 		return nil
 	})
 
-	return targets
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	key := func(path string, fn *ast.FuncDecl) string {
+		return path + "\n" + qualifiedFuncName(fn.Name.Name, receiverType(fn))
+	}
+	seen := map[string]bool{key(path, fn): true}
+
+	var out []string
+	size := 0
+	level := []decl{{path: path, fn: fn}}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		var next []decl
+		for _, caller := range level {
+			ast.Inspect(caller.fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				var name string
+				switch fun := call.Fun.(type) {
+				case *ast.Ident:
+					name = fun.Name
+				case *ast.SelectorExpr:
+					name = fun.Sel.Name
+				}
+				_, isSelector := call.Fun.(*ast.SelectorExpr)
+				for _, callee := range byName[name] {
+					k := key(callee.path, callee.fn)
+					if seen[k] {
+						continue
+					}
+					sameDir := filepath.Dir(callee.path) == filepath.Dir(caller.path)
+					isMethod := callee.fn.Recv != nil
+					if (!isSelector && (!sameDir || isMethod)) || (isSelector && sameDir != isMethod) {
+						continue
+					}
+					seen[k] = true
+					next = append(next, callee)
+				}
+				return true
+			})
+		}
+
+		for _, callee := range next {
+			if size >= limit {
+				return out
+			}
+			text := fmt.Sprintf("// %s\n%s %s", filepath.Base(callee.path), extractSignature(callee.fset, callee.fn), extractBody(callee.fset, callee.fn))
+			out = append(out, text)
+			size += len(text)
+		}
+		level = next
+	}
+	return out
+}
+
+// calledTargetSources returns the source of the called targets that are generated by now,
+// in the format of findCalledFuncs. Targets still holding an lx.Gen call are left out. The
+// result stops growing once it passes limit bytes.
+func calledTargetSources(called []TargetInfo, limit int) []string {
+	var out []string
+	size := 0
+	for _, t := range called {
+		if size >= limit {
+			break
+		}
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, t.FilePath, nil, parser.ParseComments)
+		if err != nil {
+			continue
+		}
+		fn := findFuncDecl(file, t.FuncName, t.ReceiverType)
+		if fn == nil || fn.Body == nil || hasLxGenCall(fn.Body) {
+			continue
+		}
+		text := fmt.Sprintf("// %s\n%s %s", filepath.Base(t.FilePath), extractSignature(fset, fn), extractBody(fset, fn))
+		out = append(out, text)
+		size += len(text)
+	}
+	return out
+}
+
+func callsFunc(call *ast.CallExpr, name string) bool {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		return fun.Name == name
+	case *ast.SelectorExpr:
+		return fun.Sel.Name == name
+	}
+	return false
+}
+
+var durationUnits = map[string]time.Duration{
+	"Nanosecond":  time.Nanosecond,
+	"Microsecond": time.Microsecond,
+	"Millisecond": time.Millisecond,
+	"Second":      time.Second,
+	"Minute":      time.Minute,
+	"Hour":        time.Hour,
+}
+
+// durationLiteral evaluates constant duration expressions such as 30*time.Second or
+// time.Minute + 30*time.Second.
+func durationLiteral(expr ast.Expr) (time.Duration, bool) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return durationLiteral(e.X)
+	case *ast.BasicLit:
+		if e.Kind != token.INT {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(e.Value, 0, 64)
+		return time.Duration(n), err == nil
+	case *ast.SelectorExpr:
+		if x, ok := e.X.(*ast.Ident); ok && x.Name == "time" {
+			d, ok := durationUnits[e.Sel.Name]
+			return d, ok
+		}
+	case *ast.CallExpr:
+		if sel, ok := e.Fun.(*ast.SelectorExpr); ok && len(e.Args) == 1 {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == "time" && sel.Sel.Name == "Duration" {
+				return durationLiteral(e.Args[0])
+			}
+		}
+	case *ast.BinaryExpr:
+		a, ok1 := durationLiteral(e.X)
+		b, ok2 := durationLiteral(e.Y)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		switch e.Op {
+		case token.MUL:
+			return a * b, true
+		case token.ADD:
+			return a + b, true
+		case token.SUB:
+			return a - b, true
+		}
+	}
+	return 0, false
+}
+
+func stringLiteral(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+func filterTargets(targets []TargetInfo, only, exclude string) []TargetInfo {
+	if strings.TrimSpace(only) == "" && strings.TrimSpace(exclude) == "" {
+		return targets
+	}
+
+	out := make([]TargetInfo, 0, len(targets))
+	for _, t := range targets {
+		if funcSelected(t.FilePath, t.FuncName, t.ReceiverType, only, exclude) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// funcSelected reports whether the function name (with receiver recv) declared in file
+// passes -only and -exclude. An -only of "file:<path>" selects every function in that file.
+func funcSelected(file, name, recv, only, exclude string) bool {
+	names := []string{name, qualifiedFuncName(name, recv)}
+
+	for _, pattern := range strings.Split(exclude, ",") {
+		if matchFuncPattern(strings.TrimSpace(pattern), names) {
+			return false
+		}
+	}
+
+	only = strings.TrimSpace(only)
+	if only == "" {
+		return true
+	}
+	if p, ok := strings.CutPrefix(only, "file:"); ok {
+		return matchFilePath(p, file)
+	}
+	for _, n := range names {
+		if matchFuncName(only, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFuncPattern(pattern string, names []string) bool {
+	if pattern == "" {
+		return false
+	}
+	for _, n := range names {
+		if n == pattern {
+			return true
+		}
+		if ok, err := path.Match(pattern, n); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFuncName matches an -only pattern against a function name: exactly, as a glob when
+// the pattern has glob characters, and otherwise as a substring, so "User" selects
+// "FetchUser" and "(*UserService).Save".
+func matchFuncName(pattern, candidate string) bool {
+	if pattern == "" {
+		return false
+	}
+	if pattern == candidate {
+		return true
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, err := path.Match(pattern, candidate)
+		return err == nil && ok
+	}
+	return strings.Contains(candidate, pattern)
+}
+
+// matchFilePath reports whether file is the source file named by pattern, given either as
+// a path relative to the working directory or as a trailing part of the path.
+func matchFilePath(pattern, file string) bool {
+	pattern = filepath.Clean(strings.TrimSpace(pattern))
+	if pattern == "." || file == "" {
+		return false
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if abs, err := filepath.Abs(pattern); err == nil && abs == file {
+		return true
+	}
+	return strings.HasSuffix(filepath.ToSlash(file), "/"+filepath.ToSlash(pattern))
+}
+
+// fileConfigOverrides collects the key=value pairs of "// lx:config" comments placed above
+// the package clause.
+func fileConfigOverrides(node *ast.File) map[string]string {
+	var overrides map[string]string
+	for _, cg := range node.Comments {
+		if cg.Pos() >= node.Package {
+			break
+		}
+		for _, c := range cg.List {
+			rest, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(c.Text, "//")), "lx:config")
+			if !ok {
+				continue
+			}
+			for _, field := range strings.Fields(rest) {
+				key, value, ok := strings.Cut(field, "=")
+				if !ok {
+					continue
+				}
+				if overrides == nil {
+					overrides = map[string]string{}
+				}
+				overrides[key] = value
+			}
+		}
+	}
+	return overrides
+}
+
+// examplePairLiterals reads lx.ExamplePair composite literals, keyed or positional. Pairs that
+// use local variables and other arguments, such as a spread slice, are only known at runtime
+// and are skipped.
+func examplePairLiterals(fset *token.FileSet, args []ast.Expr) []ExamplePair {
+	var pairs []ExamplePair
+	for _, arg := range args {
+		lit, ok := arg.(*ast.CompositeLit)
+		if !ok {
+			continue
+		}
+		if sel, ok := lit.Type.(*ast.SelectorExpr); !ok || sel.Sel.Name != "ExamplePair" {
+			continue
+		}
+		var p ExamplePair
+		static := true
+		for i, elt := range lit.Elts {
+			field, value := "", elt
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				if id, ok := kv.Key.(*ast.Ident); ok {
+					field = id.Name
+				}
+				value = kv.Value
+			} else if i == 0 {
+				field = "Input"
+			} else if i == 1 {
+				field = "Output"
+			}
+			if !isStaticExpr(value) {
+				static = false
+			}
+			switch field {
+			case "Input":
+				p.Input = nodeToString(fset, value)
+			case "Output":
+				p.Output = nodeToString(fset, value)
+			}
+		}
+		if static {
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
+
+func hasExamplePairs(targets []TargetInfo) bool {
+	for _, t := range targets {
+		if len(t.ExamplePairs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaticExpr reports whether e reads no variables: literals, composite literals, conversions
+// and qualified names such as time.Second.
+func isStaticExpr(e ast.Expr) bool {
+	static := true
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.CompositeLit:
+			for _, elt := range x.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					elt = kv.Value
+				}
+				static = static && isStaticExpr(elt)
+			}
+			return false
+		case *ast.CallExpr:
+			for _, arg := range x.Args {
+				static = static && isStaticExpr(arg)
+			}
+			return false
+		case *ast.SelectorExpr:
+			return false
+		case *ast.FuncLit:
+			static = false
+		case *ast.Ident:
+			if x.Name != "true" && x.Name != "false" && x.Name != "nil" {
+				static = false
+			}
+		}
+		return static
+	})
+	return static
+}
+
+// buildDependencyGraph orders targets so that a function is generated after the target
+// functions it calls, letting the prompt for the caller show their new bodies. It returns
+// batches in that order; targets within a batch do not depend on each other. Calls are
+// matched by name: plain calls to functions in the same directory, selector calls to
+// methods in the same directory or functions elsewhere. A call cycle is an error.
+func buildDependencyGraph(root string, targets []TargetInfo) ([][]TargetInfo, error) {
+	type funcNode struct {
+		path, name, recv string
+		targets          []TargetInfo
+		deps             map[int]bool
+	}
+
+	var nodes []*funcNode
+	index := make(map[string]int)
+	for _, t := range targets {
+		path := t.FilePath
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		key := path + "\n" + qualifiedFuncName(t.FuncName, t.ReceiverType)
+		i, ok := index[key]
+		if !ok {
+			i = len(nodes)
+			index[key] = i
+			nodes = append(nodes, &funcNode{path: path, name: t.FuncName, recv: t.ReceiverType, deps: make(map[int]bool)})
+		}
+		nodes[i].targets = append(nodes[i].targets, t)
+	}
+
+	edges := 0
+	files := make(map[string]*ast.File)
+	for i, n := range nodes {
+		file, ok := files[n.path]
+		if !ok {
+			var err error
+			if file, err = parser.ParseFile(token.NewFileSet(), n.path, nil, 0); err != nil {
+				return nil, err
+			}
+			files[n.path] = file
+		}
+		fn := findFuncDecl(file, n.name, n.recv)
+		if fn == nil || fn.Body == nil {
+			continue
+		}
+
+		ast.Inspect(fn.Body, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			for j, callee := range nodes {
+				if j == i || n.deps[j] || !callsFunc(call, callee.name) {
+					continue
+				}
+				_, isSelector := call.Fun.(*ast.SelectorExpr)
+				sameDir := filepath.Dir(callee.path) == filepath.Dir(n.path)
+				if (!isSelector && sameDir && callee.recv == "") ||
+					(isSelector && sameDir == (callee.recv != "")) {
+					n.deps[j] = true
+					edges++
+				}
+			}
+			return true
+		})
+	}
+
+	if edges == 0 {
+		return [][]TargetInfo{targets}, nil
+	}
+
+	var batches [][]TargetInfo
+	done := make([]bool, len(nodes))
+	for remaining := len(nodes); remaining > 0; {
+		var ready []int
+		for i, n := range nodes {
+			if done[i] {
+				continue
+			}
+			blocked := false
+			for j := range n.deps {
+				if !done[j] {
+					blocked = true
+					break
+				}
+			}
+			if !blocked {
+				ready = append(ready, i)
+			}
+		}
+		if len(ready) == 0 {
+			var cycle []string
+			for i, n := range nodes {
+				if !done[i] {
+					cycle = append(cycle, qualifiedFuncName(n.name, n.recv))
+				}
+			}
+			return nil, fmt.Errorf("call cycle between targets: %s", strings.Join(cycle, ", "))
+		}
+
+		var batch []TargetInfo
+		for _, i := range ready {
+			done[i] = true
+			var called []TargetInfo
+			for j := range nodes[i].deps {
+				called = append(called, nodes[j].targets[0])
+			}
+			slices.SortFunc(called, func(a, b TargetInfo) int {
+				return cmp.Or(cmp.Compare(a.FilePath, b.FilePath), cmp.Compare(a.FuncName, b.FuncName))
+			})
+			for _, t := range nodes[i].targets {
+				t.CalledTargets = called
+				batch = append(batch, t)
+			}
+		}
+		batches = append(batches, batch)
+		remaining -= len(ready)
+	}
+	return batches, nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const funcLitFixture = `package main
+
+import "github.com/chebread/lx"
+
+var double = func(n int) int {
+	lx.Gen("twice n")
+	return 0
+}
+
+func Run() int {
+	double := func(n int) int {
+		lx.Gen("three times n")
+		return 0
+	}
+	return double(2)
+}
+
+func Other() int {
+	var double = func(n int) int {
+		lx.Gen("four times n")
+		return 0
+	}
+	return double(2)
+}
+`
+
+func TestFuncLitTargets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(path, []byte(funcLitFixture), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	var run TargetInfo
+	for _, target := range scanProjectForLx(dir, pathFilter{}) {
+		names = append(names, target.FuncName)
+		if target.FuncName == "Run.double" {
+			run = target
+		}
+	}
+	if want := []string{"double", "Run.double", "Other.double"}; !slices.Equal(names, want) {
+		t.Fatalf("targets = %v, want %v", names, want)
+	}
+	if run.Prompt != "three times n" {
+		t.Errorf("Run.double prompt = %q, want %q", run.Prompt, "three times n")
+	}
+
+	job := &genJob{target: run, prompt: run.Prompt}
+	if err := writeGeneratedBody(options{skipCompileCheck: true, formatter: "gofmt"}, job, "return n * 3", &sync.Mutex{}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "\tdouble := func(n int) int {\n\t\t// lx-prompt: three times n\n\t\treturn n * 3\n\t}\n") {
+		t.Errorf("Run.double body not written:\n%s", out)
+	}
+	if strings.Count(string(out), "lx.Gen(") != 2 {
+		t.Errorf("another literal was rewritten:\n%s", out)
+	}
+}
+
+func TestFuncLitInstrumentation(t *testing.T) {
+	out := instrumentSource(t, funcLitFixture)
+	for _, want := range []string{
+		`return lx.Spy[int]("double", 0)`,
+		`return lx.Spy[int]("Run.double", 0)`,
+		`return lx.Spy[int]("Other.double", 0)`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s:\n%s", want, out)
+		}
+	}
+	// The enclosing functions have no lx.Gen of their own.
+	if strings.Contains(out, "return lx.Spy[int](\"Run\"") || strings.Count(out, "return double(2)") != 2 {
+		t.Errorf("enclosing function was instrumented:\n%s", out)
+	}
+}
+
+func TestCalledTargetBodiesInPrompt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	src := `package main
+
+import "github.com/chebread/lx"
+
+func Total(prices []int) int {
+	lx.Gen("sum of prices after discount")
+	return Discount(0)
+}
+
+func Discount(p int) int {
+	lx.Gen("p minus ten percent")
+	return 0
+}
+`
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	batches, err := buildDependencyGraph(dir, scanProjectForLx(dir, pathFilter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || batches[0][0].FuncName != "Discount" || batches[1][0].FuncName != "Total" {
+		t.Fatalf("batches = %v, want Discount before Total", batches)
+	}
+	total := batches[1][0]
+	if len(total.CalledTargets) != 1 || total.CalledTargets[0].FuncName != "Discount" {
+		t.Fatalf("CalledTargets = %v, want Discount", total.CalledTargets)
+	}
+
+	opts := options{maxBodyChars: 4000, formatter: "gofmt", skipCompileCheck: true, minBodyLines: defaultMinBodyLines}
+	// Still a stub: nothing to show.
+	job, err := prepareGenJob(opts, &Config{}, total, &sync.Mutex{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(job.spec, "[CALLED FUNCTIONS]") {
+		t.Errorf("stub callee in the prompt:\n%s", job.spec)
+	}
+
+	discount := batches[0][0]
+	if err := writeGeneratedBody(opts, &genJob{target: discount, prompt: discount.Prompt}, "return p * 9 / 10", &sync.Mutex{}); err != nil {
+		t.Fatal(err)
+	}
+	if job, err = prepareGenJob(opts, &Config{}, total, &sync.Mutex{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(job.spec, "[CALLED FUNCTIONS]") || !strings.Contains(job.spec, "return p * 9 / 10") {
+		t.Errorf("generated callee missing from the prompt:\n%s", job.spec)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// statusEntry is one function in the lx status output.
+type statusEntry struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Func   string `json:"func"`
+	State  string `json:"state"`
+	Prompt string `json:"prompt"`
+}
+
+const (
+	stateStub      = "stub"      // the body is an lx.Gen call and a placeholder return
+	stateGenerated = "generated" // the body carries an // lx-prompt: comment
+	stateCustom    = "custom"    // the body has lx.Gen and code lx did not write
+)
+
+// runStatus prints the generation state of every function that has an lx.Gen call or was
+// generated by lx. Like scan, it only parses the sources.
+func runStatus(args []string) error {
+	fset := flag.NewFlagSet("status", flag.ContinueOnError)
+	format := fset.String("format", "table", "Output format: table or json")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("invalid -format %q (want table or json)", *format)
+	}
+
+	root := "."
+	if fset.NArg() > 0 {
+		root = fset.Arg(0)
+	}
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+
+	entries := collectStatus(root)
+	if *format == "json" {
+		if entries == nil {
+			entries = []statusEntry{}
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(data))
+		return err
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tFILE\tFUNCTION\tPROMPT")
+	for _, e := range entries {
+		file := e.File
+		if rel, err := filepath.Rel(absRoot, file); err == nil {
+			file = rel
+		}
+		fmt.Fprintf(w, "[%s]\t%s:%d\t%s\t%s\n", e.State, file, e.Line, e.Func, truncateString(singleLine(e.Prompt), 60))
+		counts[e.State]++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Printf("\n%d functions: %d stub, %d generated, %d custom\n",
+		len(entries), counts[stateStub], counts[stateGenerated], counts[stateCustom])
+	return err
+}
+
+func collectStatus(root string) []statusEntry {
+	// Prompts of lx.Gen calls come from the scanner, which knows every lx.Gen variant.
+	genPrompts := make(map[string]string)
+	for _, t := range scanProjectForLx(root, pathFilter{}) {
+		key := t.FilePath + "\n" + qualifiedFuncName(t.FuncName, t.ReceiverType)
+		if _, ok := genPrompts[key]; !ok {
+			genPrompts[key] = t.Prompt
+		}
+	}
+
+	var entries []statusEntry
+	_ = walkGoFiles(root, pathFilter{}, func(path string, d fs.DirEntry) error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil
+		}
+		fset := token.NewFileSet()
+		node, err := parser.ParseFile(fset, abs, nil, parser.ParseComments)
+		if err != nil {
+			return nil
+		}
+
+		for _, fn := range funcDecls(node) {
+			if fn.Body == nil {
+				continue
+			}
+			name := qualifiedFuncName(fn.Name.Name, receiverType(fn))
+			genPrompt, hasGen := genPrompts[abs+"\n"+name]
+
+			entry := statusEntry{File: abs, Line: fset.Position(fn.Pos()).Line, Func: name, Prompt: genPrompt}
+			switch {
+			case hasLxPromptIn(node, fn):
+				entry.State = stateGenerated
+				if stubs := generatedStubs(node, fn); len(stubs) > 0 && !hasGen {
+					prompts := make([]string, len(stubs))
+					for i, stub := range stubs {
+						prompts[i] = stub.prompt
+					}
+					entry.Prompt = strings.Join(prompts, "; ")
+				}
+			case !hasGen:
+				continue
+			case bodyLogicLines(fset, abs, fn) > defaultMinBodyLines:
+				entry.State = stateCustom
+			default:
+				entry.State = stateStub
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func companionTestPath(path string) string {
+	return strings.TrimSuffix(path, ".go") + "_lx_test.go"
+}
+
+// companionTestName is the name generated tests use, so lx can run exactly that test.
+func companionTestName(target TargetInfo) string {
+	if target.ReceiverType == "" {
+		return "TestLx" + target.FuncName
+	}
+	recv := strings.TrimSuffix(strings.TrimPrefix(target.ReceiverType, "*"), "[...]")
+	return "TestLx" + recv + "_" + target.FuncName
+}
+
+// runCompanionTest runs the companion test of job's function. ran is false when there is no
+// companion test file to run.
+func runCompanionTest(ctx context.Context, opts options, job *genJob) (output string, ran bool, err error) {
+	if _, err := os.Stat(companionTestPath(job.target.FilePath)); err != nil {
+		return "", false, nil
+	}
+	args := []string{"test", "-count=1", "-run", "^" + companionTestName(job.target) + "$"}
+	if opts.tags != "" {
+		args = append(args, "-tags", opts.tags)
+	}
+	args = append(args, ".")
+
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = filepath.Dir(job.target.FilePath)
+	out, err := cmd.CombinedOutput()
+	return string(out), true, err
+}
+
+// runPackageTests runs every test of the package holding job's function (-verify) and logs
+// the outcome with its duration.
+func runPackageTests(ctx context.Context, opts options, job *genJob, attempt int) (output string, err error) {
+	args := []string{"test", "-count=1"}
+	if opts.tags != "" {
+		args = append(args, "-tags", opts.tags)
+	}
+	args = append(args, ".")
+
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = filepath.Dir(job.target.FilePath)
+	out, err := cmd.CombinedOutput()
+	elapsed := time.Since(start).Milliseconds()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("tests: FAIL (%dms)", elapsed), "task", job.taskName, "attempt", attempt+1)
+	} else {
+		logger.Info(fmt.Sprintf("tests: PASS (%dms)", elapsed), "task", job.taskName)
+	}
+	return string(out), err
+}
+
+// generateCompanionTest asks the LLM for a table-driven test of a freshly generated body
+// and writes it next to the source file. Failures only log a warning.
+func generateCompanionTest(ctx context.Context, opts options, llm LLM, cfg *Config, job *genJob, body string, fileMu *sync.Mutex) {
+	target := job.target
+	if strings.HasSuffix(target.FilePath, "_test.go") {
+		return
+	}
+	testPath := companionTestPath(target.FilePath)
+
+	warn := func(format string, args ...any) {
+		logger.Warn("test generation: "+fmt.Sprintf(format, args...), "task", job.taskName)
+	}
+
+	if _, err := os.Stat(testPath); err == nil {
+		warn("%s already exists, skipping", testPath)
+		return
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, target.FilePath, nil, parser.PackageClauseOnly)
+	if err != nil {
+		warn("%v", err)
+		return
+	}
+
+	generated, err := llm.Generate(ctx, cfg.Model, buildTestPrompt(file.Name.Name, companionTestName(target), job.signature, body, target.Output))
+	if err != nil {
+		warn("%s", diagnoseLLMError(err))
+		return
+	}
+
+	src := []byte(strings.TrimSpace(stripCodeFence(generated)) + "\n")
+	if formatted, _, err := formatSource(opts.formatter, testPath, src); err == nil {
+		src = formatted
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	if _, err := os.Stat(testPath); err == nil {
+		warn("%s already exists, skipping", testPath)
+		return
+	}
+	if !opts.skipCompileCheck {
+		if out, err := checkCompiles(testPath, src, opts.tags); err != nil {
+			warn("generated test does not compile, not written: %v\n%s", err, out)
+			return
+		}
+	}
+	if err := os.WriteFile(testPath, src, 0o644); err != nil {
+		warn("%v", err)
+		return
+	}
+
+	logger.Info("test written", "task", job.taskName, "file", testPath)
+}
+
+func buildTestPrompt(pkg, testName, signature, body, output string) string {
+	return fmt.Sprintf(`GO TEST GEN.
+
+Write a Go table-driven test function for this function body.
+
+PACKAGE: %s
+SIG: %s
+BODY:
+%s
+
+[SAMPLE OUTPUT]
+%s
+
+RULES:
+1. Output ONE complete Go file: "package %s", the imports it needs, and the test function(s).
+2. Use only the standard library. Name the test %s.
+3. Use a []struct{...} table and t.Run for each case.
+4. NO MARKDOWN. NO EXPLANATIONS.`, pkg, signature, body, output, pkg, testName)
+}
+
+// stripCodeFence returns the content of the first Markdown code fence in code. The rest of
+// the opening line, such as a "go" language tag, is dropped, and the fence ends at the first
+// line that starts with ``` (an unterminated fence runs to the end). Code without a fence is
+// returned unchanged.
+func stripCodeFence(code string) string {
+	start := strings.Index(code, "```")
+	if start == -1 {
+		return code
+	}
+	nl := strings.Index(code[start:], "\n")
+	if nl == -1 {
+		return code
+	}
+
+	lines := strings.SplitAfter(code[start+nl+1:], "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			return strings.Join(lines[:i], "")
+		}
+	}
+	return strings.Join(lines, "")
+}
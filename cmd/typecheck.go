@@ -0,0 +1,152 @@
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// findSpyTypeErrors type-checks every package touched by instrumentation with the
+// instrumented sources swapped in. It returns, per instrumented file, the functions whose
+// spy calls introduced type errors. Packages that do not type-check before instrumentation
+// either, or hold instrumented _test.go files, are not judged.
+func findSpyTypeErrors(instrumented map[string][]byte, tags string) map[string][]string {
+	// The source importer always resolves through build.Default, running go list in its Dir.
+	saved := build.Default
+	defer func() { build.Default = saved }()
+	ctxt := &build.Default
+	if tags != "" {
+		ctxt.BuildTags = splitBuildTags(tags)
+	}
+
+	abs := make(map[string][]byte, len(instrumented))
+	orig := make(map[string]string, len(instrumented))
+	byDir := make(map[string][]string)
+	for path, src := range instrumented {
+		a, err := filepath.Abs(path)
+		if err != nil {
+			continue
+		}
+		abs[a], orig[a] = src, path
+		dir := filepath.Dir(a)
+		if strings.HasSuffix(a, "_test.go") {
+			byDir[dir] = nil
+			continue
+		}
+		if paths, ok := byDir[dir]; ok && paths == nil {
+			continue
+		}
+		byDir[dir] = append(byDir[dir], a)
+	}
+
+	bad := make(map[string][]string)
+	for dir, paths := range byDir {
+		if paths == nil {
+			continue
+		}
+		ctxt.Dir = dir
+		fset := token.NewFileSet()
+		imp := importer.ForCompiler(fset, "source", nil)
+
+		names := packageFiles(ctxt, dir)
+		if len(names) == 0 {
+			continue
+		}
+
+		if len(typeCheckDir(fset, imp, dir, names, nil)) > 0 {
+			continue
+		}
+
+		errs := typeCheckDir(fset, imp, dir, names, abs)
+		files := make(map[string]*ast.File)
+		for _, e := range errs {
+			a := e.Fset.Position(e.Pos).Filename
+			path, ok := orig[a]
+			if !ok {
+				continue
+			}
+			if files[path] == nil {
+				files[path], _ = parser.ParseFile(token.NewFileSet(), a, abs[a], 0)
+			}
+			name := enclosingFunc(files[path], e.Fset.Position(e.Pos).Offset)
+			if !slices.Contains(bad[path], name) {
+				bad[path] = append(bad[path], name)
+			}
+		}
+	}
+	for _, names := range bad {
+		slices.Sort(names)
+	}
+	return bad
+}
+
+// packageFiles lists the non-test Go files in dir that match the build context.
+func packageFiles(ctxt *build.Context, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || filepath.Ext(name) != ".go" || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ok, err := ctxt.MatchFile(dir, name); err == nil && ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func typeCheckDir(fset *token.FileSet, imp types.Importer, dir string, names []string, overlay map[string][]byte) []types.Error {
+	var files []*ast.File
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		var src any
+		if data, ok := overlay[path]; ok {
+			src = data
+		}
+		f, err := parser.ParseFile(fset, path, src, 0)
+		if err != nil {
+			return []types.Error{{Fset: fset, Msg: err.Error()}}
+		}
+		files = append(files, f)
+	}
+
+	var errs []types.Error
+	conf := types.Config{
+		Importer:    imp,
+		FakeImportC: true,
+		Error: func(err error) {
+			if te, ok := err.(types.Error); ok && !te.Soft {
+				errs = append(errs, te)
+			}
+		},
+	}
+	_, _ = conf.Check(files[0].Name.Name, fset, files, nil)
+	return errs
+}
+
+func enclosingFunc(file *ast.File, offset int) string {
+	if file == nil {
+		return "?"
+	}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		if int(fn.Pos())-1 <= offset && offset < int(fn.End())-1 {
+			return qualifiedFuncName(fn.Name.Name, receiverType(fn))
+		}
+	}
+	return "?"
+}
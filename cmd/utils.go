@@ -5,14 +5,66 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/format"
 	"go/token"
 	"io"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"syscall"
 )
 
+// redactSecret is the configured API key, masked out of anything lx prints or reports.
+var redactSecret = os.Getenv("LX_API_KEY")
+
+func redact(s, secret string) string {
+	if secret == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, secret, "<redacted>")
+}
+
+// defaultSanitizePatterns match email addresses, credit card numbers and IPv4 addresses.
+var defaultSanitizePatterns = []string{
+	`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	`\b(?:\d{4}[ -]?){3}\d{1,4}\b`,
+	`\b(?:\d{1,3}\.){3}\d{1,3}\b`,
+}
+
+// compileSanitizePatterns compiles the sanitize_patterns of a config, or the defaults when
+// none are set.
+func compileSanitizePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		patterns = defaultSanitizePatterns
+	}
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("sanitize_patterns: %w", err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// sanitizePrompt replaces every match of patterns in s with [REDACTED] and returns the
+// number of replacements.
+func sanitizePrompt(s string, patterns []*regexp.Regexp) (string, int) {
+	n := 0
+	for _, re := range patterns {
+		s = re.ReplaceAllStringFunc(s, func(string) string {
+			n++
+			return "[REDACTED]"
+		})
+	}
+	return s, n
+}
+
 func mustRandomToken(nBytes int) string {
 	b := make([]byte, nBytes)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
@@ -23,10 +75,152 @@ func mustRandomToken(nBytes int) string {
 }
 
 func normalizeFuncName(full string) string {
-	if idx := strings.LastIndex(full, "."); idx != -1 {
-		return full[idx+1:]
+	name := full
+	if idx := strings.LastIndex(name, "/"); idx != -1 {
+		name = name[idx+1:]
+	}
+	if idx := strings.Index(name, "."); idx != -1 {
+		name = name[idx+1:]
+	}
+	return name
+}
+
+func receiverType(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return ""
+	}
+
+	expr := fn.Recv.List[0].Type
+	prefix := ""
+	if star, ok := expr.(*ast.StarExpr); ok {
+		prefix = "*"
+		expr = star.X
+	}
+
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return prefix + t.Name
+	case *ast.IndexExpr:
+		if id, ok := t.X.(*ast.Ident); ok {
+			return prefix + id.Name + "[...]"
+		}
+	case *ast.IndexListExpr:
+		if id, ok := t.X.(*ast.Ident); ok {
+			return prefix + id.Name + "[...]"
+		}
+	}
+	return ""
+}
+
+func receiverName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 || len(fn.Recv.List[0].Names) == 0 {
+		return ""
+	}
+	return fn.Recv.List[0].Names[0].Name
+}
+
+// qualifiedFuncName mirrors the runtime.FuncForPC naming (minus the package)
+// so traces of methods can be told apart: "Fetch", "Repo.Fetch", "(*Repo).Fetch".
+func qualifiedFuncName(name, recv string) string {
+	switch {
+	case recv == "":
+		return name
+	case strings.HasPrefix(recv, "*"):
+		return "(" + recv + ")." + name
+	default:
+		return recv + "." + name
+	}
+}
+
+func findFuncDecl(node *ast.File, name, recv string) *ast.FuncDecl {
+	for _, fn := range funcDecls(node) {
+		if fn.Name.Name == name && receiverType(fn) == recv {
+			return fn
+		}
+	}
+	return nil
+}
+
+// funcDecls returns the top-level functions of node followed by funcLitDecls(node).
+func funcDecls(node *ast.File) []*ast.FuncDecl {
+	var fns []*ast.FuncDecl
+	for _, decl := range node.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			fns = append(fns, fn)
+		}
+	}
+	return append(fns, funcLitDecls(node)...)
+}
+
+// funcLitDecls returns a FuncDecl for every function literal assigned to a variable, as in
+// var fn = func() int {...} or fn := func() int {...}. A package-level literal is named after
+// its variable; one inside a function is named after the enclosing function too, as in
+// Outer.fn, so literals with the same variable name in different functions stay apart. The
+// FuncDecl shares Type and Body with the literal, so changes to the body's statements reach
+// the file.
+func funcLitDecls(node *ast.File) []*ast.FuncDecl {
+	var fns []*ast.FuncDecl
+	for _, decl := range node.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			if fn.Body != nil {
+				collectFuncLits(fn.Body, qualifiedFuncName(fn.Name.Name, receiverType(fn)), &fns)
+			}
+			continue
+		}
+		collectFuncLits(decl, "", &fns)
+	}
+	return fns
+}
+
+// collectFuncLits appends to fns the variable-assigned function literals under root, named
+// prefix.name, or just name when prefix is empty. Literals nested in one of them take its
+// name as their prefix.
+func collectFuncLits(root ast.Node, prefix string, fns *[]*ast.FuncDecl) {
+	visit := func(name, value ast.Expr) {
+		id, ok := name.(*ast.Ident)
+		lit, isLit := value.(*ast.FuncLit)
+		if !ok || !isLit || id.Name == "_" {
+			collectFuncLits(value, prefix, fns)
+			return
+		}
+		full := id.Name
+		if prefix != "" {
+			full = prefix + "." + id.Name
+		}
+		*fns = append(*fns, &ast.FuncDecl{Name: &ast.Ident{NamePos: id.NamePos, Name: full}, Type: lit.Type, Body: lit.Body})
+		collectFuncLits(lit.Body, full, fns)
 	}
-	return full
+	ast.Inspect(root, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.ValueSpec:
+			if len(n.Names) == len(n.Values) {
+				for i := range n.Names {
+					visit(n.Names[i], n.Values[i])
+				}
+				return false
+			}
+		case *ast.AssignStmt:
+			if len(n.Lhs) == len(n.Rhs) {
+				for i := range n.Lhs {
+					visit(n.Lhs[i], n.Rhs[i])
+				}
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// funcLitBodies returns the bodies of the variable-assigned function literals under root.
+// An lx.Gen inside one of them belongs to the literal, not to the enclosing function.
+func funcLitBodies(root ast.Node) map[*ast.BlockStmt]bool {
+	var fns []*ast.FuncDecl
+	collectFuncLits(root, "", &fns)
+	bodies := make(map[*ast.BlockStmt]bool, len(fns))
+	for _, fn := range fns {
+		bodies[fn.Body] = true
+	}
+	return bodies
 }
 
 func safeValuePreview(kind string, raw json.RawMessage, max int) string {
@@ -101,3 +295,95 @@ func extractBody(fset *token.FileSet, fn *ast.FuncDecl) string {
 	}
 	return buf.String()
 }
+
+// splitShellArgs splits s into arguments like a POSIX shell would, honouring single quotes,
+// double quotes and backslash escapes. No expansion is done.
+func splitShellArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// writeFileAtomic replaces the file at path with data by writing path+".lx.tmp" and renaming
+// it over path, so a run killed mid-write leaves either the old or the new content. A
+// symlink is followed and its target replaced. If the rename cannot be done, e.g. across
+// filesystems, it warns and writes path in place instead.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	tmpPath := path + ".lx.tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// OpenFile applies the umask; keep the mode of the file being replaced.
+	_ = os.Chmod(tmpPath, perm)
+
+	err = os.Rename(tmpPath, path)
+	if err == nil {
+		return nil
+	}
+	os.Remove(tmpPath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	logger.Warn("atomic rename not possible, writing the file in place", "file", path, "err", err)
+	return os.WriteFile(path, data, perm)
+}
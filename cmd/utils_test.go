@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(path, []byte("package main\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("package main\n\nfunc F() {}\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, path, "package main\n\nfunc F() {}\n")
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %v, %v; want 0640", info.Mode().Perm(), err)
+	}
+	if _, err := os.Stat(path + ".lx.tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+}
+
+// TestWriteFileAtomicInterrupted simulates a run killed while writing: the half-written data
+// only ever lands in the temp file, and the original stays intact until the rename.
+func TestWriteFileAtomicInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	original := "package main\n\nfunc F() int { return 1 }\n"
+	if err := os.WriteFile(path, []byte(original), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A run killed mid-write leaves a partial temp file next to the source.
+	if err := os.WriteFile(path+".lx.tmp", []byte("package main\n\nfunc F() int {"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, path, original)
+
+	// The next write replaces the stale temp file and completes normally.
+	if err := writeFileAtomic(path, []byte("package main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, path, "package main\n")
+}
+
+func TestWriteFileAtomicFailureKeepsOriginal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	original := "package main\n"
+	if err := os.WriteFile(path, []byte(original), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in place of the temp file makes the write fail before the rename.
+	if err := os.Mkdir(path+".lx.tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("package broken"), 0o644); err == nil {
+		t.Fatal("expected an error")
+	}
+	assertFile(t, path, original)
+}
+
+func TestWriteFileAtomicFollowsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "real.go")
+	link := filepath.Join(dir, "link.go")
+	if err := os.WriteFile(target, []byte("package a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	if err := writeFileAtomic(link, []byte("package b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, target, "package b\n")
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link was replaced by a regular file")
+	}
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s = %q, want %q", filepath.Base(path), got, want)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	watchPollInterval = 500 * time.Millisecond
+	watchDebounce     = 500 * time.Millisecond
+)
+
+// watchAndRerun polls .go files under root and calls run after a change has settled.
+// It returns on SIGINT/SIGTERM.
+func watchAndRerun(root string, filter pathFilter, run func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	logger.Info("Watching for changes (Ctrl+C to stop)", "dir", root)
+	last := snapshotGoFiles(root, filter)
+	var changedAt time.Time
+
+	for {
+		select {
+		case <-sig:
+			logger.Info("Watch stopped")
+			return
+		case <-ticker.C:
+		}
+
+		cur := snapshotGoFiles(root, filter)
+		if !sameSnapshot(last, cur) {
+			last = cur
+			changedAt = time.Now()
+			continue
+		}
+		if changedAt.IsZero() || time.Since(changedAt) < watchDebounce {
+			continue
+		}
+
+		changedAt = time.Time{}
+		logger.Info("Change detected, re-running")
+		// The signal handler installed during capture must win while files are instrumented.
+		signal.Stop(sig)
+		run()
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+		// lx's own writes are not user edits.
+		last = snapshotGoFiles(root, filter)
+		logger.Info("Watching for changes (Ctrl+C to stop)", "dir", root)
+	}
+}
+
+func snapshotGoFiles(root string, filter pathFilter) map[string]time.Time {
+	snap := make(map[string]time.Time)
+	_ = walkGoFiles(root, filter, func(path string, d fs.DirEntry) error {
+		if info, err := d.Info(); err == nil {
+			snap[path] = info.ModTime()
+		}
+		return nil
+	})
+	return snap
+}
+
+func sameSnapshot(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, t := range a {
+		if u, ok := b[path]; !ok || !u.Equal(t) {
+			return false
+		}
+	}
+	return true
+}
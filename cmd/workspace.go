@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// findGoWork returns the absolute path of root/go.work, or "" when root is not a workspace.
+func findGoWork(root string) string {
+	abs, err := filepath.Abs(filepath.Join(root, "go.work"))
+	if err != nil {
+		return ""
+	}
+	if info, err := os.Stat(abs); err != nil || info.IsDir() {
+		return ""
+	}
+	return abs
+}
+
+// parseGoWorkUse returns the directories listed in the use directives of a go.work file,
+// resolved relative to the file's directory.
+func parseGoWorkUse(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.Dir(path)
+	var dirs []string
+	add := func(s string) {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return
+		}
+		if unq, err := strconv.Unquote(s); err == nil {
+			s = unq
+		}
+		if !filepath.IsAbs(s) {
+			s = filepath.Join(base, s)
+		}
+		dirs = append(dirs, filepath.Clean(s))
+	}
+
+	inBlock := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case inBlock && line == ")":
+			inBlock = false
+		case inBlock:
+			add(line)
+		case line == "use (":
+			inBlock = true
+		case strings.HasPrefix(line, "use "):
+			add(strings.TrimPrefix(line, "use "))
+		}
+	}
+	return dirs, nil
+}
+
+// projectRoots returns root plus any go.work module directories outside it.
+func projectRoots(root string) []string {
+	roots := []string{root}
+	work := findGoWork(root)
+	if work == "" {
+		return roots
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return roots
+	}
+	dirs, err := parseGoWorkUse(work)
+	if err != nil {
+		return roots
+	}
+	for _, dir := range dirs {
+		if rel, err := filepath.Rel(absRoot, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		roots = append(roots, dir)
+	}
+	return roots
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeWorkspace lays out a go.work at dir/ws that uses the module ws/app and the module
+// tool next to ws, outside the project root. The tool command imports a package of app, so
+// it only builds when the workspace is in effect.
+func writeWorkspace(t *testing.T) (root, tool string) {
+	t.Helper()
+	dir := t.TempDir()
+	root = filepath.Join(dir, "ws")
+	tool = filepath.Join(dir, "tool")
+	files := map[string]string{
+		"ws/go.work":            "go 1.25\n\nuse (\n\t./app\n\t../tool // outside the root\n)\n",
+		"ws/app/go.mod":         "module example.com/app\n\ngo 1.25\n",
+		"ws/app/greet/greet.go": "package greet\n\nfunc Hello() string { return \"hello\" }\n",
+		"ws/app/gen/gen.go":     "package gen\n\nimport \"github.com/chebread/lx\"\n\nfunc Double(n int) int {\n\tlx.Gen(\"twice n\")\n\treturn 0\n}\n",
+		"tool/go.mod":           "module example.com/tool\n\ngo 1.25\n",
+		"tool/main.go":          "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/app/greet\"\n)\n\nfunc main() { fmt.Println(greet.Hello()) }\n",
+		"tool/gen/gen.go":       "package gen\n\nimport \"github.com/chebread/lx\"\n\nfunc Upper(s string) string {\n\tlx.Gen(\"s in upper case\")\n\treturn \"\"\n}\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, tool
+}
+
+func TestParseGoWorkUse(t *testing.T) {
+	root, tool := writeWorkspace(t)
+	dirs, err := parseGoWorkUse(filepath.Join(root, "go.work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "app"), tool}
+	if !slices.Equal(dirs, want) {
+		t.Errorf("use dirs = %v, want %v", dirs, want)
+	}
+	if got := projectRoots(root); !slices.Equal(got, []string{root, tool}) {
+		t.Errorf("projectRoots = %v, want %v", got, []string{root, tool})
+	}
+}
+
+func TestWorkspaceTargets(t *testing.T) {
+	root, tool := writeWorkspace(t)
+
+	var found []string
+	for _, target := range scanProjectForLx(root, pathFilter{}) {
+		found = append(found, target.FuncName+" "+target.FilePath)
+	}
+	slices.Sort(found)
+	want := []string{
+		"Double " + filepath.Join(root, "app", "gen", "gen.go"),
+		"Upper " + filepath.Join(tool, "gen", "gen.go"),
+	}
+	if !slices.Equal(found, want) {
+		t.Errorf("targets = %v, want %v", found, want)
+	}
+
+	mains, err := findMainPackages(root, pathFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(mains, []string{tool}) {
+		t.Errorf("main packages = %v, want %v", mains, []string{tool})
+	}
+}
+
+func TestWorkspaceCapture(t *testing.T) {
+	root, tool := writeWorkspace(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// tool lies outside root, so go only finds the workspace through GOWORK.
+	if _, err := executeSinglePackage(ctx, "go", tool, options{targetDir: root, timeout: time.Minute}, false); err != nil {
+		t.Errorf("capture with the workspace: %v", err)
+	}
+	if _, err := executeSinglePackage(ctx, "go", tool, options{targetDir: tool, timeout: time.Minute}, false); err == nil {
+		t.Errorf("capture without the workspace built, want an unresolved import of example.com/app")
+	}
+}
@@ -1,17 +1,26 @@
 package lx
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"reflect"
 	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var traceMu sync.Mutex
 
+// traceCount maps a function name to the *atomic.Int64 number of traces sent for it.
+var traceCount sync.Map
+
 type tracePayload struct {
 	Kind     string      `json:"kind"`
 	Function string      `json:"function"`
@@ -21,8 +30,46 @@ type tracePayload struct {
 }
 
 // Gen captures the prompt at runtime when LX_MODE=capture and LX_TRACE_TOKEN is set.
+// Otherwise it is a no-op. An optional timeout (e.g. 30*time.Second) overrides the lx
+// -timeout for this function's LLM calls; it is read from the source, not at runtime.
+func Gen(prompt string, timeout ...time.Duration) {
+	captureGen(prompt, nil)
+}
+
+// ExamplePair is one expected input/output of a function generated with GenWithExamples.
+type ExamplePair struct {
+	Input  any
+	Output any
+}
+
+// GenWithExamples works like Gen, but also hands the LLM explicit input/output pairs.
+// Pairs written as lx.ExamplePair literals are read straight from the source, so library
+// code without a runnable main can still be generated. At runtime (LX_MODE=capture and
+// LX_TRACE_TOKEN set) every pair is recorded as an "EXAMPLE_PAIR" trace.
 // Otherwise it is a no-op.
-func Gen(prompt string) {
+func GenWithExamples(prompt string, examples ...ExamplePair) {
+	captureGen(prompt, examples)
+}
+
+// GenIf works like Gen, but only when condition is true. When it is false, GenIf is a
+// no-op even in capture mode, so lx leaves the function alone.
+func GenIf(condition bool, prompt string) {
+	if !condition {
+		return
+	}
+	captureGen(prompt, nil)
+}
+
+// GenCtx works like Gen, but emits nothing once ctx is done, so a function reached while
+// the program shuts down does not leave a spurious trace.
+func GenCtx(ctx context.Context, prompt string, timeout ...time.Duration) {
+	if ctx.Err() != nil {
+		return
+	}
+	captureGen(prompt, nil)
+}
+
+func captureGen(prompt string, examples []ExamplePair) {
 	if os.Getenv("LX_MODE") != "capture" {
 		return
 	}
@@ -32,7 +79,7 @@ func Gen(prompt string) {
 		return
 	}
 
-	pc, file, line, ok := runtime.Caller(1)
+	pc, file, line, ok := runtime.Caller(2)
 	if !ok {
 		return
 	}
@@ -48,6 +95,15 @@ func Gen(prompt string) {
 		File:     file,
 		Line:     line,
 	})
+	for _, ex := range examples {
+		sendTrace(token, tracePayload{
+			Kind:     "EXAMPLE_PAIR",
+			Function: fn.Name(),
+			Value:    map[string]any{"input": ex.Input, "output": ex.Output},
+			File:     file,
+			Line:     line,
+		})
+	}
 }
 
 // Spy captures return values at runtime when LX_MODE=capture and LX_TRACE_TOKEN is set.
@@ -74,7 +130,231 @@ func Spy[T any](funcName string, val T) T {
 	return val
 }
 
+// SpyMulti works like Spy, but every call is kept: lx hands all captured values to the LLM
+// instead of only the last one. Use it for functions called with varied inputs.
+func SpyMulti[T any](funcName string, val T) T {
+	if os.Getenv("LX_MODE") != "capture" {
+		return val
+	}
+	token := os.Getenv("LX_TRACE_TOKEN")
+	if token == "" {
+		return val
+	}
+
+	_, file, line, _ := runtime.Caller(1)
+
+	sendTrace(token, tracePayload{
+		Kind:     "OUTPUT_MULTI",
+		Function: funcName,
+		Value:    val,
+		File:     file,
+		Line:     line,
+	})
+
+	return val
+}
+
+// SpyJSON works like Spy, but records a struct (or pointer to one) as a map of its exported
+// fields keyed by Go field name, so fields tagged `json:"-"` still show the LLM the shape of
+// the type. With includeFields, only the named fields are recorded, which keeps sensitive
+// values out of the trace. Values that are not structs are recorded as they are.
+func SpyJSON[T any](funcName string, val T, includeFields ...string) T {
+	if os.Getenv("LX_MODE") != "capture" {
+		return val
+	}
+	token := os.Getenv("LX_TRACE_TOKEN")
+	if token == "" {
+		return val
+	}
+
+	_, file, line, _ := runtime.Caller(1)
+
+	sendTrace(token, tracePayload{
+		Kind:     "OUTPUT",
+		Function: funcName,
+		Value:    structFields(val, includeFields),
+		File:     file,
+		Line:     line,
+	})
+
+	return val
+}
+
+// structFields returns the exported fields of the struct v points to or holds, limited to
+// include when it is not empty. Other values are returned unchanged.
+func structFields(v any, include []string) any {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return v
+	}
+
+	var wanted map[string]bool
+	if len(include) > 0 {
+		wanted = make(map[string]bool, len(include))
+		for _, name := range include {
+			wanted[name] = true
+		}
+	}
+
+	out := make(map[string]any)
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if !f.IsExported() || (wanted != nil && !wanted[f.Name]) {
+			continue
+		}
+		out[f.Name] = rv.Field(i).Interface()
+	}
+	return out
+}
+
+// SpyCtx works like Spy, but records nothing once ctx is done.
+func SpyCtx[T any](ctx context.Context, funcName string, val T) T {
+	if os.Getenv("LX_MODE") != "capture" || ctx.Err() != nil {
+		return val
+	}
+	token := os.Getenv("LX_TRACE_TOKEN")
+	if token == "" {
+		return val
+	}
+
+	_, file, line, _ := runtime.Caller(1)
+
+	sendTrace(token, tracePayload{
+		Kind:     "OUTPUT",
+		Function: funcName,
+		Value:    val,
+		File:     file,
+		Line:     line,
+	})
+
+	return val
+}
+
+// SpyError captures an error return value at runtime when LX_MODE=capture and LX_TRACE_TOKEN is set.
+// Non-nil errors are recorded with their message and a short stack excerpt.
+// Otherwise it returns err unchanged.
+func SpyError(funcName string, err error) error {
+	if os.Getenv("LX_MODE") != "capture" {
+		return err
+	}
+	token := os.Getenv("LX_TRACE_TOKEN")
+	if token == "" {
+		return err
+	}
+
+	_, file, line, _ := runtime.Caller(1)
+
+	var value interface{}
+	if err != nil {
+		value = map[string]string{
+			"error": err.Error(),
+			"stack": stackExcerpt(10),
+		}
+	}
+
+	sendTrace(token, tracePayload{
+		Kind:     "OUTPUT",
+		Function: funcName,
+		Value:    value,
+		File:     file,
+		Line:     line,
+	})
+
+	return err
+}
+
+// stackExcerpt returns the goroutine header and the first n frames of the current stack.
+func stackExcerpt(n int) string {
+	lines := strings.Split(strings.TrimRight(string(debug.Stack()), "\n"), "\n")
+	// Each frame is a function line followed by a file:line line.
+	if limit := 1 + 2*n; len(lines) > limit {
+		lines = lines[:limit]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Lang records a Go assertion example for funcName when LX_MODE=capture and LX_TRACE_TOKEN is set.
+// The example is passed to the LLM as a test the generated body must satisfy. It is recorded
+// as text and never executed, since during capture funcName is still a stub.
+// Otherwise it is a no-op.
+func Lang(funcName, examples string) {
+	if os.Getenv("LX_MODE") != "capture" {
+		return
+	}
+	token := os.Getenv("LX_TRACE_TOKEN")
+	if token == "" {
+		return
+	}
+
+	_, file, line, _ := runtime.Caller(1)
+
+	sendTrace(token, tracePayload{
+		Kind:     "EXAMPLE",
+		Function: funcName,
+		Value:    examples,
+		File:     file,
+		Line:     line,
+	})
+}
+
+// Assert records an "ASSERT_FAIL" trace with message and the caller location when condition is false,
+// LX_MODE=capture and LX_TRACE_TOKEN is set. Unlike panic it never stops the program.
+// Otherwise it is a no-op.
+func Assert(condition bool, message string) {
+	if condition || os.Getenv("LX_MODE") != "capture" {
+		return
+	}
+	token := os.Getenv("LX_TRACE_TOKEN")
+	if token == "" {
+		return
+	}
+
+	pc, file, line, _ := runtime.Caller(1)
+	name := ""
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		name = fn.Name()
+	}
+
+	sendTrace(token, tracePayload{
+		Kind:     "ASSERT_FAIL",
+		Function: name,
+		Value:    message,
+		File:     file,
+		Line:     line,
+	})
+}
+
+// MustCompile marks funcName for a mandatory build check: lx builds the package with the
+// generated body before writing it, even with -skip-compile-check, and never writes a body
+// that does not build. It is a no-op at runtime.
+func MustCompile(funcName string) {}
+
+// Hint adds text to the prompt of the lx.Gen call in the same function, such as a step the
+// body should follow. lx reads it from the source; it is a no-op at runtime.
+func Hint(text string) {}
+
+// Import declares a package the generated body of the function may use. lx adds the
+// import to the file when the body refers to it. It is a no-op at runtime.
+func Import(pkg string) {}
+
 func sendTrace(token string, p tracePayload) {
+	if limit := traceMaxPerFunc(); limit > 0 {
+		c, _ := traceCount.LoadOrStore(p.Function, new(atomic.Int64))
+		if n := c.(*atomic.Int64).Add(1); n > int64(limit) {
+			if n == int64(limit)+1 {
+				fmt.Fprintf(os.Stderr, "[lx] trace limit reached for %s\n", p.Function)
+			}
+			return
+		}
+	}
+
 	// Optional bound to prevent huge trace lines (DoS risk).
 	maxBytes := traceMaxBytes()
 
@@ -99,7 +379,36 @@ func sendTrace(token string, p tracePayload) {
 	defer traceMu.Unlock()
 
 	// Single line output for robust scanner parsing.
-	fmt.Printf("%s%s%s\n", start, string(b), end)
+	fmt.Fprintf(traceOutput(), "%s%s%s\n", start, string(b), end)
+}
+
+var (
+	traceFileOnce sync.Once
+	traceFile     *os.File
+)
+
+// traceOutput returns the file named by LX_TRACE_FILE, opened once in append mode, so
+// traces stay out of the program's stdout. Without it, or if it cannot be opened, traces
+// go to stdout.
+func traceOutput() io.Writer {
+	traceFileOnce.Do(func() {
+		if path := os.Getenv("LX_TRACE_FILE"); path != "" {
+			traceFile, _ = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		}
+	})
+	if traceFile != nil {
+		return traceFile
+	}
+	return os.Stdout
+}
+
+// traceMaxPerFunc reads LX_TRACE_MAX_PER_FUNC. Zero means no limit.
+func traceMaxPerFunc() int {
+	n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("LX_TRACE_MAX_PER_FUNC")))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
 }
 
 func traceMaxBytes() int {
@@ -136,3 +445,74 @@ func SpyVoid(funcName string) {
 		Line:     line,
 	})
 }
+
+// SpyVoidArgs records the arguments a void function was called with as an "OUTPUT_VOID"
+// trace when LX_MODE=capture and LX_TRACE_TOKEN is set, so the LLM sees what the function
+// works on. Deferred, it is registered at the top of the body and its arguments are the inputs.
+// Otherwise it is a no-op.
+func SpyVoidArgs(funcName string, args ...any) {
+	if os.Getenv("LX_MODE") != "capture" {
+		return
+	}
+	token := os.Getenv("LX_TRACE_TOKEN")
+	if token == "" {
+		return
+	}
+
+	_, file, line, _ := runtime.Caller(1)
+
+	values := make([]any, len(args))
+	for i, a := range args {
+		values[i] = stringified(a)
+	}
+	sendTrace(token, tracePayload{
+		Kind:     "OUTPUT_VOID",
+		Function: funcName,
+		Value:    values,
+		File:     file,
+		Line:     line,
+	})
+}
+
+// SpyCapture records the side effects of a void function, such as the state of its pointer,
+// slice or map parameters, when LX_MODE=capture and LX_TRACE_TOKEN is set.
+// Values implementing fmt.Stringer are recorded as their String() form.
+// Otherwise it is a no-op.
+func SpyCapture(funcName string, sideEffect any) {
+	if os.Getenv("LX_MODE") != "capture" {
+		return
+	}
+	token := os.Getenv("LX_TRACE_TOKEN")
+	if token == "" {
+		return
+	}
+
+	_, file, line, _ := runtime.Caller(1)
+
+	sendTrace(token, tracePayload{
+		Kind:     "OUTPUT",
+		Function: funcName,
+		Value:    stringified(sideEffect),
+		File:     file,
+		Line:     line,
+	})
+}
+
+func stringified(v any) any {
+	if m, ok := v.(map[string]any); ok {
+		out := make(map[string]any, len(m))
+		for k, val := range m {
+			out[k] = stringified(val)
+		}
+		return out
+	}
+	if s, ok := v.(fmt.Stringer); ok && !isNilPointer(v) {
+		return s.String()
+	}
+	return v
+}
+
+func isNilPointer(v any) bool {
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Pointer && rv.IsNil()
+}
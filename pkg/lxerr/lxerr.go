@@ -0,0 +1,87 @@
+// Package lxerr defines the errors lx reports for each of its failure modes, so callers can
+// tell them apart with errors.As instead of matching messages.
+package lxerr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ErrConfigNotFound is returned when no config file exists and no LX_* environment variable
+// is set.
+type ErrConfigNotFound struct {
+	SearchedPaths []string
+}
+
+func (e *ErrConfigNotFound) Error() string {
+	return fmt.Sprintf("could not find 'lx-config.yaml' or 'lx-config.toml' file (searched: %s)", strings.Join(e.SearchedPaths, ", "))
+}
+
+// ErrCompileFailed is returned when a generated body does not build or, with -strict-vet,
+// does not pass go vet. Output holds the compiler or vet output.
+type ErrCompileFailed struct {
+	File   string
+	Output string
+	Err    error
+}
+
+func (e *ErrCompileFailed) Error() string {
+	return fmt.Sprintf("compile check failed: %v", e.Err)
+}
+
+func (e *ErrCompileFailed) Unwrap() error { return e.Err }
+
+// ErrLLMFailed is returned when the LLM provider could not produce a response.
+type ErrLLMFailed struct {
+	Provider string
+	Cause    error
+}
+
+func (e *ErrLLMFailed) Error() string {
+	if e.Provider == "" {
+		return fmt.Sprintf("llm request failed: %v", e.Cause)
+	}
+	return fmt.Sprintf("%s request failed: %v", e.Provider, e.Cause)
+}
+
+func (e *ErrLLMFailed) Unwrap() error { return e.Cause }
+
+// ErrNoTargets is returned when a run finds no lx.Gen call left to generate under Dir.
+type ErrNoTargets struct {
+	Dir string
+}
+
+func (e *ErrNoTargets) Error() string {
+	return fmt.Sprintf("no conversion target under %s", e.Dir)
+}
+
+// ErrTimeout is returned when a stage of the run, such as "capture" or "generation", did not
+// finish within its time limit.
+type ErrTimeout struct {
+	Stage string
+	After time.Duration
+}
+
+func (e *ErrTimeout) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Stage, e.After)
+}
+
+// TypeName returns the name of the lxerr type found in err's chain, such as
+// "ErrCompileFailed", or "" when there is none.
+func TypeName(err error) string {
+	for _, target := range []any{
+		new(*ErrConfigNotFound),
+		new(*ErrCompileFailed),
+		new(*ErrLLMFailed),
+		new(*ErrNoTargets),
+		new(*ErrTimeout),
+	} {
+		if errors.As(err, target) {
+			return reflect.TypeOf(target).Elem().Elem().Name()
+		}
+	}
+	return ""
+}